@@ -22,6 +22,18 @@ import (
 // of a client's IP address.
 type GeoIP2 struct {
 	Enable string `json:"enable,omitempty"`
+	// Instance is the name of the geoip2 instance to look up.
+	// Defaults to the databases configured outside of instances.
+	Instance string `json:"instance,omitempty"`
+	// NotReady is the policy for requests arriving before all
+	// databases are loaded:
+	// - "pass" looks up the databases loaded so far (default).
+	// - "reject" responds with 503 Service Unavailable.
+	// - "fallback" sets the Fallback values instead of looking up.
+	NotReady string `json:"not_ready,omitempty"`
+	// Fallback maps variable names without the geoip2. prefix,
+	// e.g. country_code, to the values used by the fallback policy.
+	Fallback map[string]string `json:"fallback,omitempty"`
 
 	state *GeoIP2State
 	ctx   caddy.Context
@@ -45,6 +57,13 @@ const (
 	modeDisabled       mode = "disabled"
 )
 
+// These are the possible values of GeoIP2.NotReady.
+const (
+	notReadyPass     = "pass"
+	notReadyReject   = "reject"
+	notReadyFallback = "fallback"
+)
+
 func init() {
 	caddy.RegisterModule(&GeoIP2{})
 	httpcaddyfile.RegisterHandlerDirective("geoip2_vars", parseCaddyfile)
@@ -54,7 +73,7 @@ func init() {
 func (m *GeoIP2) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.handlers.geoip2",
-		New: func() caddy.Module { return m },
+		New: func() caddy.Module { return new(GeoIP2) },
 	}
 }
 
@@ -63,6 +82,22 @@ func (m *GeoIP2) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhtt
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 	replacer.SetDefaultValues(repl)
 
+	ready := m.state != nil && m.state.isReady()
+	repl.Set("geoip2.ready", ready)
+	if !ready && m.mode != modeDisabled {
+		switch m.NotReady {
+		case notReadyReject:
+			return caddyhttp.Error(http.StatusServiceUnavailable, errors.New("geoip databases not loaded yet"))
+		case notReadyFallback:
+			for name, value := range m.Fallback {
+				repl.Set("geoip2."+name, value)
+			}
+			return next.ServeHTTP(w, r)
+		}
+	}
+	// Blocking handlers read {geoip2.stale} to apply their on_stale policy.
+	repl.Set("geoip2.stale", m.mode != modeDisabled && m.state != nil && m.state.isStale())
+
 	if m.mode != modeDisabled {
 		if m.state != nil && m.state.hasDBReaders() {
 			clientIP, err := m.getClientIP(r)
@@ -120,11 +155,40 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 }
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	geoip2_vars <mode> {
+//	    instance  <name>
+//	    not_ready pass|reject|fallback
+//	    fallback  <name> <value>
+//	}
 func (m *GeoIP2) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		if !d.Args(&m.Enable) {
 			return d.ArgErr()
 		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "instance":
+				if !d.Args(&m.Instance) || d.NextArg() {
+					return d.ArgErr()
+				}
+			case "not_ready":
+				if !d.Args(&m.NotReady) || d.NextArg() {
+					return d.ArgErr()
+				}
+			case "fallback":
+				var name, value string
+				if !d.Args(&name, &value) || d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.Fallback == nil {
+					m.Fallback = make(map[string]string)
+				}
+				m.Fallback[strings.TrimPrefix(name, "geoip2.")] = value
+			default:
+				return d.Errf("unrecognized subdirective %q", d.Val())
+			}
+		}
 	}
 	return nil
 }
@@ -136,7 +200,10 @@ func (m *GeoIP2) Provision(ctx caddy.Context) error {
 	if err != nil {
 		return fmt.Errorf("getting geoip2 app: %w", err)
 	}
-	m.state = app.(*GeoIP2State)
+	m.state, err = app.(*GeoIP2State).instance(m.Instance)
+	if err != nil {
+		return err
+	}
 	m.ctx = ctx
 
 	switch strings.ToLower(m.Enable) {
@@ -155,6 +222,15 @@ func (m *GeoIP2) Provision(ctx caddy.Context) error {
 // Validate implements caddy.Validator.
 func (m *GeoIP2) Validate() error {
 	caddy.Log().Named("http.handlers.geoip2").Debug("validate")
+	switch m.NotReady {
+	case "", notReadyPass, notReadyReject:
+	case notReadyFallback:
+		if len(m.Fallback) == 0 {
+			return errors.New("not_ready fallback requires fallback values")
+		}
+	default:
+		return fmt.Errorf("unrecognized not_ready policy %q", m.NotReady)
+	}
 	return nil
 }
 
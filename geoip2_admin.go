@@ -0,0 +1,237 @@
+package geoip2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// adminAPI implements the admin.api.geoip2 module, which
+// exposes the runtime state of this plugin:
+//
+//	GET  /geoip2/rate_limits         lists the buckets of all rate limiters.
+//	GET  /geoip2/databases           lists the databases and their kept versions.
+//	POST /geoip2/databases/rollback  rolls a database back to a kept version and pins it.
+//	POST /geoip2/databases/pin       pins a database to its current version.
+//	POST /geoip2/databases/unpin     resumes the updates of a database.
+//
+// The POST requests take a JSON body like
+//
+//	{"instance": "", "database": "GeoLite2-City", "version": 1718000000}
+//
+// where instance is the name of a geoip2 instance, empty for the
+// databases outside of instances, and version is the build epoch of
+// the version to roll back to, which defaults to the previous one.
+type adminAPI struct{}
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// CaddyModule implements caddy.Module.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.geoip2",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/geoip2/rate_limits",
+			Handler: caddy.AdminHandlerFunc(a.handleRateLimits),
+		},
+		{
+			Pattern: "/geoip2/databases",
+			Handler: caddy.AdminHandlerFunc(a.handleDatabases),
+		},
+		{
+			Pattern: "/geoip2/databases/rollback",
+			Handler: caddy.AdminHandlerFunc(a.handleRollback),
+		},
+		{
+			Pattern: "/geoip2/databases/pin",
+			Handler: caddy.AdminHandlerFunc(a.handlePin),
+		},
+		{
+			Pattern: "/geoip2/databases/unpin",
+			Handler: caddy.AdminHandlerFunc(a.handleUnpin),
+		},
+	}
+}
+
+func (a *adminAPI) handleRateLimits(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+
+	rateLimitersMu.Lock()
+	limiters := make(map[string]*rateLimiter, len(rateLimiters))
+	for name, l := range rateLimiters {
+		limiters[name] = l
+	}
+	rateLimitersMu.Unlock()
+
+	now := time.Now()
+	result := make(map[string]map[string]rateLimitStatus, len(limiters))
+	for name, l := range limiters {
+		result[name] = l.snapshot(now)
+	}
+	return writeAdminJSON(w, result)
+}
+
+// adminDatabase describes a database in admin responses.
+type adminDatabase struct {
+	Instance string `json:"instance"`
+	Database string `json:"database"`
+	Path     string `json:"path"`
+	// Loaded is the build epoch of the loaded version, if any.
+	Loaded uint `json:"loaded,omitempty"`
+	// Pinned is the build epoch of the pinned version, if any.
+	Pinned   uint   `json:"pinned,omitempty"`
+	Versions []uint `json:"versions,omitempty"`
+}
+
+func (a *adminAPI) handleDatabases(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+
+	result := []adminDatabase{}
+	seen := make(map[string]bool)
+	databasesPool.Range(func(_, value any) bool {
+		d := value.(*databases)
+		s := d.acquireReaders()
+		if s != nil {
+			defer s.release()
+		}
+		for _, db := range d.configs {
+			// Configurations being replaced by a reload
+			// share their databases with the new ones.
+			key := d.cfg.name + "/" + db.Name
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			info := adminDatabase{Instance: d.cfg.name, Database: db.Name, Path: db.Path}
+			if reader := s.reader(db.Name); reader != nil {
+				info.Loaded = reader.Metadata().BuildEpoch
+			}
+			info.Pinned, _ = pinnedVersion(db)
+			info.Versions, _ = versions(db)
+			result = append(result, info)
+		}
+		return true
+	})
+	return writeAdminJSON(w, result)
+}
+
+// adminDatabaseRequest is the body of the POST requests on databases.
+type adminDatabaseRequest struct {
+	Instance string `json:"instance"`
+	Database string `json:"database"`
+	Version  uint   `json:"version"`
+}
+
+func (a *adminAPI) handleRollback(w http.ResponseWriter, r *http.Request) error {
+	return a.handleDatabaseChange(w, r, func(d *databases, db *DatabaseConfig, req adminDatabaseRequest) (uint, error) {
+		return d.rollback(db, req.Version)
+	})
+}
+
+func (a *adminAPI) handlePin(w http.ResponseWriter, r *http.Request) error {
+	return a.handleDatabaseChange(w, r, func(d *databases, db *DatabaseConfig, _ adminDatabaseRequest) (uint, error) {
+		return d.pin(db)
+	})
+}
+
+func (a *adminAPI) handleUnpin(w http.ResponseWriter, r *http.Request) error {
+	return a.handleDatabaseChange(w, r, func(d *databases, db *DatabaseConfig, _ adminDatabaseRequest) (uint, error) {
+		if err := d.unpin(db); err != nil {
+			return 0, err
+		}
+		return buildEpoch(db.Path)
+	})
+}
+
+// handleDatabaseChange decodes the request, applies change to the requested
+// database and reloads it in all configurations sharing its file. It responds
+// with the build epoch returned by change.
+func (a *adminAPI) handleDatabaseChange(w http.ResponseWriter, r *http.Request,
+	change func(*databases, *DatabaseConfig, adminDatabaseRequest) (uint, error),
+) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+	var req adminDatabaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request: %w", err),
+		}
+	}
+
+	var dbs []*databases
+	databasesPool.Range(func(_, value any) bool {
+		if d := value.(*databases); d.cfg.name == req.Instance && d.databaseConfig(req.Database) != nil {
+			dbs = append(dbs, d)
+		}
+		return true
+	})
+	if len(dbs) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown database %q of instance %q", req.Database, req.Instance),
+		}
+	}
+
+	if dbs[0].cfg.Offline {
+		return caddy.APIError{
+			HTTPStatus: http.StatusConflict,
+			Err:        fmt.Errorf("instance %q: %w", req.Instance, errOffline),
+		}
+	}
+	epoch, err := change(dbs[0], dbs[0].databaseConfig(req.Database), req)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	for _, d := range dbs[1:] {
+		d.loadGeoIPReaders()
+	}
+	return writeAdminJSON(w, map[string]uint{"version": epoch})
+}
+
+// writeAdminJSON writes v as the JSON response of an admin request.
+func writeAdminJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("encoding response: %w", err),
+		}
+	}
+	return nil
+}
+
+// Interface guards.
+var (
+	_ caddy.Module      = (*adminAPI)(nil)
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,343 @@
+package geoip2
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"go.uber.org/zap"
+)
+
+// defaultAuthBranch is the branch name logged for
+// requests that match none of the configured branches.
+const defaultAuthBranch = "default"
+
+// GeoIP2Auth implements the http.authentication.providers.geoip2
+// authentication provider. It selects between inner authentication
+// providers by the origin of the request, e.g. to skip authentication
+// from office countries and require it from anywhere else.
+//
+// Branches are evaluated in order and the first matching branch applies;
+// requests matching no branch use the default providers. The branch taken
+// is logged for auditing. Branches use the variables of the geoip2_vars
+// handler, which must therefore run before authentication.
+type GeoIP2Auth struct {
+	// Branches select the providers by request origin.
+	Branches []*AuthBranch `json:"branches,omitempty"`
+	// ProvidersRaw are the providers used if no branch matches.
+	// If none are configured, such requests are not authenticated.
+	ProvidersRaw caddy.ModuleMap `json:"providers,omitempty" caddy:"namespace=http.authentication.providers"`
+	// OnStale is the policy while geoip2_vars reports a stale
+	// database: "serve" selects branches as usual (default),
+	// "deny" fails the authentication and "authenticate" ignores
+	// the branches and uses the default providers.
+	OnStale string `json:"on_stale,omitempty"`
+
+	providers map[string]caddyauth.Authenticator
+}
+
+// AuthBranch authenticates the requests matching its criteria.
+type AuthBranch struct {
+	// Name of the branch, used in the audit log.
+	Name string `json:"name,omitempty"`
+	GeoCriteria
+	// Skip authenticates matching requests without
+	// consulting any provider.
+	Skip bool `json:"skip,omitempty"`
+	// ProvidersRaw are the providers used for matching requests.
+	ProvidersRaw caddy.ModuleMap `json:"providers,omitempty" caddy:"namespace=http.authentication.providers"`
+
+	providers map[string]caddyauth.Authenticator
+}
+
+func init() {
+	caddy.RegisterModule(GeoIP2Auth{})
+	httpcaddyfile.RegisterHandlerDirective("geoip2_auth", parseAuthCaddyfile)
+}
+
+// CaddyModule implements caddy.Module.
+func (GeoIP2Auth) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.authentication.providers.geoip2",
+		New: func() caddy.Module { return new(GeoIP2Auth) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (a *GeoIP2Auth) Provision(ctx caddy.Context) error {
+	caddy.Log().Named("http.authentication.providers.geoip2").Debug("provision")
+	providers, err := loadAuthProviders(ctx, a, "ProvidersRaw")
+	if err != nil {
+		return err
+	}
+	a.providers = providers
+
+	for i, branch := range a.Branches {
+		if branch.Name == "" {
+			branch.Name = fmt.Sprintf("branch_%d", i)
+		}
+		if err := branch.provision(); err != nil {
+			return fmt.Errorf("branch %q: %w", branch.Name, err)
+		}
+		providers, err := loadAuthProviders(ctx, branch, "ProvidersRaw")
+		if err != nil {
+			return fmt.Errorf("branch %q: %w", branch.Name, err)
+		}
+		branch.providers = providers
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (a *GeoIP2Auth) Validate() error {
+	if err := validateOnStale(a.OnStale, onStaleAuthenticate); err != nil {
+		return err
+	}
+	for _, branch := range a.Branches {
+		if branch.empty() {
+			return fmt.Errorf("branch %q: no criteria configured", branch.Name)
+		}
+		if branch.Skip == (len(branch.ProvidersRaw) > 0) {
+			return fmt.Errorf("branch %q: either skip or providers must be configured", branch.Name)
+		}
+	}
+	return nil
+}
+
+// Authenticate implements caddyauth.Authenticator.
+func (a *GeoIP2Auth) Authenticate(w http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	stale := requestStale(repl)
+	if stale && a.OnStale == onStaleDeny {
+		return caddyauth.User{}, false, errStale
+	}
+
+	branches := a.Branches
+	if stale && a.OnStale == onStaleAuthenticate {
+		branches = nil
+	}
+	name, skip, providers := defaultAuthBranch, false, a.providers
+	for _, branch := range branches {
+		if branch.match(repl) {
+			name, skip, providers = branch.Name, branch.Skip, branch.providers
+			break
+		}
+	}
+
+	var (
+		user     caddyauth.User
+		authed   bool
+		provider string
+		errs     []error
+	)
+	if skip {
+		user, authed = caddyauth.User{Metadata: map[string]string{"geoip2_branch": name}}, true
+	} else {
+		for provName, prov := range providers {
+			u, ok, err := prov.Authenticate(w, r)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", provName, err))
+				continue
+			}
+			if ok {
+				user, authed, provider = u, true, provName
+				break
+			}
+		}
+	}
+
+	clientIP, _ := repl.GetString("geoip2.ip_address")
+	country, _ := repl.GetString("geoip2.country_code")
+	caddy.Log().Named("http.authentication.providers.geoip2").Info(
+		"authentication branch",
+		zap.String("branch", name),
+		zap.Bool("skipped", skip),
+		zap.Bool("stale", stale),
+		zap.String("provider", provider),
+		zap.Bool("authenticated", authed),
+		zap.String("user", user.ID),
+		zap.String("clientIP", clientIP),
+		zap.String("country", country),
+	)
+
+	if authed {
+		return user, true, nil
+	}
+	return user, false, errors.Join(errs...)
+}
+
+// loadAuthProviders loads the authentication providers of the
+// module map in field of s.
+func loadAuthProviders(ctx caddy.Context, s any, field string) (map[string]caddyauth.Authenticator, error) {
+	providers := make(map[string]caddyauth.Authenticator)
+	mods, err := ctx.LoadModule(s, field)
+	if err != nil {
+		return nil, fmt.Errorf("loading authentication providers: %w", err)
+	}
+	for name, mod := range mods.(map[string]any) {
+		providers[name] = mod.(caddyauth.Authenticator)
+	}
+	return providers, nil
+}
+
+func parseAuthCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	a := &GeoIP2Auth{}
+	if err := a.UnmarshalCaddyfile(h.Dispenser); err != nil {
+		return nil, err
+	}
+	return caddyauth.Authentication{
+		ProvidersRaw: caddy.ModuleMap{
+			"geoip2": caddyconfig.JSON(a, nil),
+		},
+	}, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Providers are
+// either configured with basic_auth, which has the same syntax as the
+// basic_auth directive, or with provider for any provider module that
+// supports the Caddyfile. Providers outside of a branch are the defaults.
+//
+//	geoip2_auth {
+//	    branch <name> {
+//	        countries    <codes...>
+//	        continents   <codes...>
+//	        subdivisions <codes...>
+//	        asns         <numbers...>
+//	        networks     <cidrs...>
+//	        anonymous    <flags...>
+//	        skip
+//	        basic_auth [<hash_algorithm> [<realm>]] {
+//	            <username> <hashed_password>
+//	        }
+//	        provider <module> ...
+//	    }
+//	    basic_auth ...
+//	    provider <module> ...
+//	    on_stale serve|deny|authenticate
+//	}
+func (a *GeoIP2Auth) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			if d.Val() == "on_stale" {
+				if !d.Args(&a.OnStale) || d.NextArg() {
+					return d.ArgErr()
+				}
+				continue
+			}
+			if d.Val() != "branch" {
+				if err := unmarshalAuthProvider(d, &a.ProvidersRaw); err != nil {
+					return err
+				}
+				continue
+			}
+			branch := &AuthBranch{}
+			if !d.Args(&branch.Name) {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				if d.Val() == "skip" {
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					branch.Skip = true
+					continue
+				}
+				ok, err := branch.GeoCriteria.unmarshalCaddyfile(d)
+				if err != nil {
+					return err
+				}
+				if ok {
+					continue
+				}
+				if err := unmarshalAuthProvider(d, &branch.ProvidersRaw); err != nil {
+					return err
+				}
+			}
+			a.Branches = append(a.Branches, branch)
+		}
+	}
+	return nil
+}
+
+// unmarshalAuthProvider parses the provider subdirective at the current
+// position of d into providers.
+func unmarshalAuthProvider(d *caddyfile.Dispenser, providers *caddy.ModuleMap) error {
+	if *providers == nil {
+		*providers = make(caddy.ModuleMap)
+	}
+	switch d.Val() {
+	case "basic_auth":
+		ba, err := unmarshalBasicAuth(d)
+		if err != nil {
+			return err
+		}
+		(*providers)["http_basic"] = caddyconfig.JSON(ba, nil)
+	case "provider":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		name := d.Val()
+		unm, err := caddyfile.UnmarshalModule(d, "http.authentication.providers."+name)
+		if err != nil {
+			return err
+		}
+		(*providers)[name] = caddyconfig.JSON(unm, nil)
+	default:
+		return d.Errf("unrecognized subdirective %q", d.Val())
+	}
+	return nil
+}
+
+// unmarshalBasicAuth parses a basic_auth block the
+// same way as the basic_auth directive does.
+func unmarshalBasicAuth(d *caddyfile.Dispenser) (*caddyauth.HTTPBasicAuth, error) {
+	ba := &caddyauth.HTTPBasicAuth{HashCache: new(caddyauth.Cache)}
+
+	hashName := "bcrypt"
+	args := d.RemainingArgs()
+	switch len(args) {
+	case 0:
+	case 1:
+		hashName = args[0]
+	case 2:
+		hashName, ba.Realm = args[0], args[1]
+	default:
+		return nil, d.ArgErr()
+	}
+	if hashName != "bcrypt" {
+		return nil, d.Errf("unrecognized hash algorithm: %s", hashName)
+	}
+	ba.HashRaw = caddyconfig.JSONModuleObject(caddyauth.BcryptHash{}, "algorithm", hashName, nil)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		username := d.Val()
+		var password string
+		if !d.Args(&password) || d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		ba.AccountList = append(ba.AccountList, caddyauth.Account{
+			Username: username,
+			Password: password,
+		})
+	}
+	return ba, nil
+}
+
+// Interface guards.
+var (
+	_ caddy.Module            = (*GeoIP2Auth)(nil)
+	_ caddy.Provisioner       = (*GeoIP2Auth)(nil)
+	_ caddy.Validator         = (*GeoIP2Auth)(nil)
+	_ caddyauth.Authenticator = (*GeoIP2Auth)(nil)
+	_ caddyfile.Unmarshaler   = (*GeoIP2Auth)(nil)
+)
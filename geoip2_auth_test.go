@@ -0,0 +1,99 @@
+package geoip2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+)
+
+// tokenAuth authenticates requests carrying its token.
+type tokenAuth string
+
+func (a tokenAuth) Authenticate(_ http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
+	if r.Header.Get("Authorization") == string(a) {
+		return caddyauth.User{ID: string(a)}, true, nil
+	}
+	return caddyauth.User{}, false, nil
+}
+
+func TestAuthBranches(t *testing.T) {
+	a := &GeoIP2Auth{
+		Branches: []*AuthBranch{
+			{Name: "office", GeoCriteria: GeoCriteria{Countries: []string{"DE"}}, Skip: true},
+			{
+				Name:        "risky",
+				GeoCriteria: GeoCriteria{Anonymous: []string{"anonymous"}},
+				providers:   map[string]caddyauth.Authenticator{"strong": tokenAuth("strong")},
+			},
+		},
+		providers: map[string]caddyauth.Authenticator{"basic": tokenAuth("basic")},
+	}
+	for _, branch := range a.Branches {
+		if err := branch.provision(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		vars   map[string]any
+		token  string
+		authed bool
+	}{
+		{"office without credentials", map[string]any{"geoip2.country_code": "DE"}, "", true},
+		{"elsewhere without credentials", map[string]any{"geoip2.country_code": "FR"}, "", false},
+		{"elsewhere with basic credentials", map[string]any{"geoip2.country_code": "FR"}, "basic", true},
+		{"anonymous with basic credentials", map[string]any{"geoip2.is_anonymous": true}, "basic", false},
+		{"anonymous with strong credentials", map[string]any{"geoip2.is_anonymous": true}, "strong", true},
+	} {
+		req := newGeoRequest(tc.vars)
+		req.Header.Set("Authorization", tc.token)
+		_, authed, err := a.Authenticate(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if authed != tc.authed {
+			t.Errorf("%s: authenticated = %v, want %v", tc.name, authed, tc.authed)
+		}
+	}
+}
+
+func TestAuthCaddyfile(t *testing.T) {
+	a := &GeoIP2Auth{}
+	d := caddyfile.NewTestDispenser(`
+	geoip2_auth {
+		branch office {
+			countries DE AT
+			skip
+		}
+		basic_auth bcrypt admin {
+			alice $2a$14$Zkx19XLiW6VYouLHR5NmfOFU0z2GTNmpkT/5qqR7hx4IjWJPDhjvG
+		}
+	}`)
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a.Branches) != 1 || !a.Branches[0].Skip || len(a.Branches[0].Countries) != 2 {
+		t.Fatalf("unexpected branches: %+v", a.Branches)
+	}
+	var ba caddyauth.HTTPBasicAuth
+	if err := json.Unmarshal(a.ProvidersRaw["http_basic"], &ba); err != nil {
+		t.Fatal(err)
+	}
+	if ba.Realm != "admin" || len(ba.AccountList) != 1 || ba.AccountList[0].Username != "alice" {
+		t.Fatalf("unexpected basic auth provider: %+v", ba)
+	}
+	if err := a.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := &GeoIP2Auth{Branches: []*AuthBranch{{Name: "empty", Skip: true}}}
+	if err := invalid.Validate(); err == nil {
+		t.Error("expected a branch without criteria to be invalid")
+	}
+}
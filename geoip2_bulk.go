@@ -0,0 +1,328 @@
+package geoip2
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultMaxBatchSize is the number of IP addresses accepted
+	// in a single bulk request if no maximum is configured.
+	defaultMaxBatchSize = 1000
+	// defaultMaxBodySize is the size in bytes of the request
+	// body accepted if no maximum is configured.
+	defaultMaxBodySize = 1 << 20
+)
+
+// GeoIP2Bulk implements the http.handlers.geoip2_bulk handler.
+// It accepts a POST request containing a batch of IP addresses,
+// either as a JSON array or as newline-separated text, and
+// responds with the database records of every address.
+//
+// Results are written as a JSON array, or as newline-delimited
+// JSON when the client accepts "application/x-ndjson".
+type GeoIP2Bulk struct {
+	// MaxBatchSize is the maximum number of IP addresses accepted
+	// in a single request. Defaults to 1000.
+	MaxBatchSize int `json:"max_batch_size,omitempty"`
+	// MaxBodySize is the maximum size in bytes of the request
+	// body. Defaults to 1 MiB.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	// Instance is the name of the geoip2 instance to look up.
+	// Defaults to the databases configured outside of instances.
+	Instance string `json:"instance,omitempty"`
+
+	state *GeoIP2State
+}
+
+// bulkResult is the result of a single IP address lookup.
+type bulkResult struct {
+	IP     string         `json:"ip"`
+	Record map[string]any `json:"record,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+func init() {
+	caddy.RegisterModule(GeoIP2Bulk{})
+	httpcaddyfile.RegisterHandlerDirective("geoip2_bulk", parseBulkCaddyfile)
+}
+
+// CaddyModule implements caddy.Module.
+func (GeoIP2Bulk) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geoip2_bulk",
+		New: func() caddy.Module { return new(GeoIP2Bulk) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *GeoIP2Bulk) Provision(ctx caddy.Context) error {
+	caddy.Log().Named("http.handlers.geoip2_bulk").Debug("provision")
+	app, err := ctx.App(moduleName)
+	if err != nil {
+		return fmt.Errorf("getting geoip2 app: %w", err)
+	}
+	m.state, err = app.(*GeoIP2State).instance(m.Instance)
+	if err != nil {
+		return err
+	}
+
+	if m.MaxBatchSize == 0 {
+		m.MaxBatchSize = defaultMaxBatchSize
+	}
+	if m.MaxBodySize == 0 {
+		m.MaxBodySize = defaultMaxBodySize
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (m *GeoIP2Bulk) Validate() error {
+	if m.MaxBatchSize < 0 {
+		return fmt.Errorf("max_batch_size must not be negative: %d", m.MaxBatchSize)
+	}
+	if m.MaxBodySize < 0 {
+		return fmt.Errorf("max_body_size must not be negative: %d", m.MaxBodySize)
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (m *GeoIP2Bulk) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+	}
+
+	ips, err := m.readBatch(r)
+	if err != nil {
+		return err
+	}
+
+	ndjson := acceptsNDJSON(r)
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	if !ndjson {
+		if _, err := io.WriteString(w, "["); err != nil {
+			return err
+		}
+	}
+	for i, ip := range ips {
+		if !ndjson && i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(m.lookup(ip)); err != nil {
+			caddy.Log().Named("http.handlers.geoip2_bulk").Error("writing result", zap.Error(err))
+			return err
+		}
+	}
+	if !ndjson {
+		if _, err := io.WriteString(w, "]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup resolves a single IP address of the batch.
+func (m *GeoIP2Bulk) lookup(ip string) bulkResult {
+	result := bulkResult{IP: ip}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		result.Error = fmt.Sprintf("unable to parse address: %q", ip)
+		return result
+	}
+	if m.state == nil || !m.state.hasDBReaders() {
+		result.Error = "no geoip databases loaded"
+		return result
+	}
+	record, err := m.state.record(parsedIP)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if len(record) == 0 {
+		// An empty record would be omitted from the response.
+		result.Error = "address not found"
+		return result
+	}
+	result.Record = record
+	return result
+}
+
+// readBatch reads the IP addresses from the request body. JSON arrays
+// are expected for "application/json" requests, any other content type
+// is read as newline-separated text. Empty addresses are skipped.
+func (m *GeoIP2Bulk) readBatch(r *http.Request) ([]string, error) {
+	body := r.Body
+	if m.MaxBodySize > 0 {
+		body = http.MaxBytesReader(nil, r.Body, m.MaxBodySize)
+	}
+	var ips []string
+	add := func(ip string) error {
+		if ip == "" {
+			return nil
+		}
+		if len(ips) >= m.MaxBatchSize {
+			return caddyhttp.Error(
+				http.StatusRequestEntityTooLarge,
+				fmt.Errorf("batch exceeds the maximum of %d addresses", m.MaxBatchSize),
+			)
+		}
+		ips = append(ips, ip)
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		dec := json.NewDecoder(body)
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			if bodyErr := readBodyError(err); bodyErr != nil {
+				return nil, bodyErr
+			}
+			return nil, caddyhttp.Error(http.StatusBadRequest, errors.New("expected a JSON array of addresses"))
+		}
+		for dec.More() {
+			var ip string
+			if err := dec.Decode(&ip); err != nil {
+				if bodyErr := readBodyError(err); bodyErr != nil {
+					return nil, bodyErr
+				}
+				return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("decoding address: %w", err))
+			}
+			if err := add(strings.TrimSpace(ip)); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			if bodyErr := readBodyError(err); bodyErr != nil {
+				return nil, bodyErr
+			}
+			return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("decoding addresses: %w", err))
+		}
+		return ips, nil
+	}
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		if err := add(strings.TrimSpace(scanner.Text())); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if bodyErr := readBodyError(err); bodyErr != nil {
+			return nil, bodyErr
+		}
+		return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("reading addresses: %w", err))
+	}
+	return ips, nil
+}
+
+// readBodyError returns the handler error for err if it was caused by
+// an oversized request body or line, or nil otherwise.
+func readBodyError(err error) error {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytes):
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("request body exceeds the maximum of %d bytes", maxBytes.Limit))
+	case errors.Is(err, bufio.ErrTooLong):
+		return caddyhttp.Error(http.StatusBadRequest,
+			fmt.Errorf("line exceeds the maximum of %d bytes", bufio.MaxScanTokenSize))
+	}
+	return nil
+}
+
+// acceptsNDJSON reports whether the client asked for
+// newline-delimited JSON results.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+		if mediaType == "application/x-ndjson" {
+			return true
+		}
+	}
+	return false
+}
+
+func parseBulkCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := &GeoIP2Bulk{}
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	geoip2_bulk {
+//	    max_batch_size <n>
+//	    max_body_size  <size>
+//	    instance       <name>
+//	}
+func (m *GeoIP2Bulk) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "max_batch_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("max_batch_size is not an integer: %v", err)
+				}
+				m.MaxBatchSize = size
+			case "max_body_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("max_body_size is not a size: %v", err)
+				}
+				m.MaxBodySize = int64(size)
+			case "instance":
+				if !d.Args(&m.Instance) || d.NextArg() {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unrecognized subdirective %q", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards.
+var (
+	_ caddy.Module                = (*GeoIP2Bulk)(nil)
+	_ caddy.Provisioner           = (*GeoIP2Bulk)(nil)
+	_ caddy.Validator             = (*GeoIP2Bulk)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GeoIP2Bulk)(nil)
+	_ caddyfile.Unmarshaler       = (*GeoIP2Bulk)(nil)
+)
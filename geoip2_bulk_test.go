@@ -0,0 +1,159 @@
+package geoip2
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func newTestState(t *testing.T, editionIDs ...string) *GeoIP2State {
+	t.Helper()
+	state := &GeoIP2State{
+		DatabaseDirectory: "replacer/test-data/test-data",
+		EditionIDs:        editionIDs,
+	}
+	if err := state.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	state.dbs.loadGeoIPReaders()
+	if !state.hasDBReaders() {
+		t.Fatalf("no database readers loaded for %v", editionIDs)
+	}
+	t.Cleanup(func() {
+		if err := state.Cleanup(); err != nil {
+			t.Errorf("cleaning up state: %v", err)
+		}
+	})
+	return state
+}
+
+func TestBulkJSON(t *testing.T) {
+	m := &GeoIP2Bulk{
+		MaxBatchSize: 10,
+		state:        newTestState(t, "GeoIP2-Country-Test", "GeoLite2-ASN-Test"),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`["81.2.69.160", "1.128.0.1", "bogus", "127.0.0.1"]`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	if err := m.ServeHTTP(rec, req, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []bulkResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("got %d results, want 4", len(results))
+	}
+
+	country := results[0].Record["country"].(map[string]any)
+	if got := country["iso_code"]; got != "GB" {
+		t.Errorf("country iso_code = %v, want GB", got)
+	}
+	if got := results[1].Record["autonomous_system_number"]; got != float64(1221) {
+		t.Errorf("autonomous_system_number = %v, want 1221", got)
+	}
+	if results[2].Error == "" || results[2].Record != nil {
+		t.Errorf("expected a per-address error, got %+v", results[2])
+	}
+	if results[3].Error != "address not found" || results[3].Record != nil {
+		t.Errorf("expected a not found error, got %+v", results[3])
+	}
+}
+
+func TestBulkNDJSON(t *testing.T) {
+	m := &GeoIP2Bulk{
+		MaxBatchSize: 10,
+		state:        newTestState(t, "GeoIP2-Country-Test"),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("81.2.69.160\n\n89.160.20.112\n"))
+	req.Header.Set("Accept", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	if err := m.ServeHTTP(rec, req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	var codes []string
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var result bulkResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatalf("decoding line %q: %v", scanner.Text(), err)
+		}
+		codes = append(codes, result.Record["country"].(map[string]any)["iso_code"].(string))
+	}
+	if strings.Join(codes, ",") != "GB,SE" {
+		t.Errorf("country codes = %v, want [GB SE]", codes)
+	}
+}
+
+func TestBulkMaxBatchSize(t *testing.T) {
+	m := &GeoIP2Bulk{MaxBatchSize: 2}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("1.1.1.1\n2.2.2.2\n3.3.3.3\n"))
+	err := m.ServeHTTP(httptest.NewRecorder(), req, nil)
+
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %d, got %v", http.StatusRequestEntityTooLarge, err)
+	}
+}
+
+func TestBulkEmptyAddresses(t *testing.T) {
+	m := &GeoIP2Bulk{MaxBatchSize: 10}
+	for contentType, body := range map[string]string{
+		"application/json": `["81.2.69.160", "", "  ", "1.128.0.1"]`,
+		"text/plain":       "81.2.69.160\n\n  \n1.128.0.1\n",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		ips, err := m.readBatch(req)
+		if err != nil {
+			t.Fatalf("%s: %v", contentType, err)
+		}
+		if len(ips) != 2 {
+			t.Errorf("%s: read %q, want 2 addresses", contentType, ips)
+		}
+	}
+}
+
+func TestBulkMaxBodySize(t *testing.T) {
+	m := &GeoIP2Bulk{MaxBatchSize: 1000, MaxBodySize: 64}
+	body := strings.Repeat("81.2.69.160\n", 10)
+	for _, contentType := range []string{"application/json", "text/plain"} {
+		payload := body
+		if contentType == "application/json" {
+			payload = `["` + strings.Repeat(`81.2.69.160", "`, 10) + `"]`
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(payload))
+		req.Header.Set("Content-Type", contentType)
+		_, err := m.readBatch(req)
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: expected status %d, got %v", contentType, http.StatusRequestEntityTooLarge, err)
+		}
+	}
+
+	// A line longer than the scanner buffer is a bad request.
+	m.MaxBodySize = 0
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("1", 128<<10)))
+	_, err := m.readBatch(req)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(err.Error(), "line exceeds") {
+		t.Errorf("long line: expected status %d, got %v", http.StatusBadRequest, err)
+	}
+}
@@ -0,0 +1,134 @@
+package geoip2
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/zhangjiayin/caddy-geoip2/replacer"
+)
+
+const (
+	// candidateSuffix is appended to the path of a database
+	// to store a downloaded file until it passed its checks.
+	candidateSuffix = ".candidate"
+	// rejectedSuffix is appended to the path of a database
+	// to keep a downloaded file that failed its checks.
+	rejectedSuffix = ".rejected"
+)
+
+// CanaryConfig configures the checks a downloaded database has to
+// pass before it replaces the current database file.
+type CanaryConfig struct {
+	// Lookups are the expected values of known addresses.
+	Lookups []CanaryLookup `json:"lookups,omitempty"`
+	// MinNodeCount is the minimum number of nodes of the search tree.
+	MinNodeCount uint `json:"min_node_count,omitempty"`
+	// DatabaseType is the expected database type, e.g. "GeoIP2-City".
+	DatabaseType string `json:"database_type,omitempty"`
+	// RejectOlderBuild rejects databases built before the loaded one.
+	RejectOlderBuild bool `json:"reject_older_build,omitempty"`
+}
+
+// CanaryLookup is the expected value of a field of the record of IP.
+type CanaryLookup struct {
+	IP string `json:"ip"`
+	// Field is the dotted path of the value in the record,
+	// e.g. "country.iso_code" or "autonomous_system_number".
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+// check runs the checks on r. loaded is the metadata of the
+// currently loaded database, or nil if none is loaded.
+func (c *CanaryConfig) check(r replacer.Replacer, loaded *maxminddb.Metadata) error {
+	if c == nil {
+		return nil
+	}
+	meta := r.Metadata()
+	if c.DatabaseType != "" && meta.DatabaseType != c.DatabaseType {
+		return fmt.Errorf("database type %q, want %q", meta.DatabaseType, c.DatabaseType)
+	}
+	if meta.NodeCount < c.MinNodeCount {
+		return fmt.Errorf("%d nodes, want at least %d", meta.NodeCount, c.MinNodeCount)
+	}
+	if c.RejectOlderBuild && loaded != nil && meta.BuildEpoch < loaded.BuildEpoch {
+		return fmt.Errorf("build epoch %d is older than the loaded %d", meta.BuildEpoch, loaded.BuildEpoch)
+	}
+	for _, l := range c.Lookups {
+		record, err := r.Record(net.ParseIP(l.IP))
+		if err != nil {
+			return fmt.Errorf("looking up %s: %w", l.IP, err)
+		}
+		if got := recordValue(record, l.Field); got != l.Value {
+			return fmt.Errorf("%s of %s is %q, want %q", l.Field, l.IP, got, l.Value)
+		}
+	}
+	return nil
+}
+
+// recordValue returns the value at the dotted path field of
+// record formatted as a string, or "" if there is none.
+func recordValue(record map[string]any, field string) string {
+	var value any = record
+	for key := range strings.SplitSeq(field, ".") {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return ""
+		}
+		value = m[key]
+	}
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// unmarshalCaddyfile parses a canary block.
+//
+//	canary {
+//	    lookup             <ip> <field> <value>
+//	    min_node_count     <count>
+//	    database_type      <type>
+//	    reject_older_build
+//	}
+func (c *CanaryConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "lookup":
+			var l CanaryLookup
+			if !d.Args(&l.IP, &l.Field, &l.Value) || d.NextArg() {
+				return d.ArgErr()
+			}
+			if net.ParseIP(l.IP) == nil {
+				return d.Errf("invalid canary IP address %q", l.IP)
+			}
+			c.Lookups = append(c.Lookups, l)
+		case "min_node_count":
+			var value string
+			if !d.Args(&value) || d.NextArg() {
+				return d.ArgErr()
+			}
+			count, err := strconv.ParseUint(value, 10, 0)
+			if err != nil {
+				return d.Errf("min_node_count is not a number: %v", err)
+			}
+			c.MinNodeCount = uint(count)
+		case "database_type":
+			if !d.Args(&c.DatabaseType) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "reject_older_build":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.RejectOlderBuild = true
+		default:
+			return d.Errf("unrecognized canary subdirective %q", d.Val())
+		}
+	}
+	return nil
+}
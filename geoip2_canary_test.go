@@ -0,0 +1,144 @@
+package geoip2
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/zhangjiayin/caddy-geoip2/replacer"
+)
+
+func TestCanaryCheck(t *testing.T) {
+	r, err := replacer.New("replacer/test-data/test-data/GeoIP2-Country-Test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	meta := r.Metadata()
+	newer := meta
+	newer.BuildEpoch++
+
+	tests := []struct {
+		name   string
+		canary *CanaryConfig
+		loaded *maxminddb.Metadata
+		ok     bool
+	}{
+		{"none", nil, nil, true},
+		{"lookup", &CanaryConfig{Lookups: []CanaryLookup{{"81.2.69.160", "country.iso_code", "GB"}}}, nil, true},
+		{"wrong lookup", &CanaryConfig{Lookups: []CanaryLookup{{"81.2.69.160", "country.iso_code", "US"}}}, nil, false},
+		{"missing field", &CanaryConfig{Lookups: []CanaryLookup{{"81.2.69.160", "city.names.en", "London"}}}, nil, false},
+		{"node count", &CanaryConfig{MinNodeCount: meta.NodeCount}, nil, true},
+		{"too few nodes", &CanaryConfig{MinNodeCount: meta.NodeCount + 1}, nil, false},
+		{"database type", &CanaryConfig{DatabaseType: "GeoIP2-Country"}, nil, true},
+		{"wrong database type", &CanaryConfig{DatabaseType: "GeoIP2-City"}, nil, false},
+		{"same build", &CanaryConfig{RejectOlderBuild: true}, &meta, true},
+		{"older build", &CanaryConfig{RejectOlderBuild: true}, &newer, false},
+		{"older build allowed", &CanaryConfig{}, &newer, true},
+	}
+	for _, tt := range tests {
+		if err := tt.canary.check(r, tt.loaded); (err == nil) != tt.ok {
+			t.Errorf("%s: check returned %v", tt.name, err)
+		}
+	}
+}
+
+func TestCanaryCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`{
+		lookup 81.2.69.160 country.iso_code GB
+		min_node_count 1000
+		database_type GeoIP2-Country
+		reject_older_build
+	}`)
+	var c CanaryConfig
+	if err := c.unmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Lookups) != 1 || c.Lookups[0] != (CanaryLookup{"81.2.69.160", "country.iso_code", "GB"}) ||
+		c.MinNodeCount != 1000 || c.DatabaseType != "GeoIP2-Country" || !c.RejectOlderBuild {
+		t.Errorf("unexpected canary config: %+v", c)
+	}
+
+	d = caddyfile.NewTestDispenser(`{
+		lookup example.com country.iso_code GB
+	}`)
+	if err := new(CanaryConfig).unmarshalCaddyfile(d); err == nil {
+		t.Error("invalid canary IP address accepted")
+	}
+}
+
+func TestCanaryRejectsDownload(t *testing.T) {
+	var requests atomic.Int64
+	srv := newUpdateServer(t, &requests)
+
+	update := func(dir string, canary *CanaryConfig) *databases {
+		d := newDatabases(GeoIP2State{
+			AccountID:         1,
+			LicenseKey:        "key",
+			DatabaseDirectory: dir,
+			LockFile:          filepath.Join(dir, "geoip2.lock"),
+			Databases:         []*DatabaseConfig{{EditionID: "GeoIP2-Country-Test", Canary: canary}},
+			UpdateURL:         srv.URL,
+		})
+		d.loadGeoIPReaders()
+		d.wg.Add(1)
+		d.runGeoIPUpdate()
+		t.Cleanup(func() { d.Destruct() })
+		return d
+	}
+
+	// A failed check keeps the candidate aside.
+	dir := t.TempDir()
+	path := filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	update(dir, &CanaryConfig{Lookups: []CanaryLookup{{"81.2.69.160", "country.iso_code", "US"}}})
+	if _, err := os.Stat(path); err == nil {
+		t.Error("rejected database promoted")
+	}
+	if _, err := os.Stat(path + rejectedSuffix); err != nil {
+		t.Errorf("rejected database not kept: %v", err)
+	}
+	state, err := loadUpdateState(filepath.Join(dir, updateStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds := state.Databases["GeoIP2-Country-Test"]; ds == nil || ds.LastError == "" {
+		t.Errorf("rejection not recorded in the update state: %+v", ds)
+	}
+
+	// A database of another type than the loaded one is rejected,
+	// and the previous version keeps serving.
+	dir = t.TempDir()
+	path = filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	replaceFile(t, path, readTestDatabase(t, "GeoIP2-City-Test"))
+	d := update(dir, nil)
+	if got := d.readers.Load().reader("GeoIP2-Country-Test").Metadata().DatabaseType; got != "GeoIP2-City" {
+		t.Errorf("loaded database type %q after a rejected download", got)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(readTestDatabase(t, "GeoIP2-City-Test")) {
+		t.Error("previous database file replaced by a rejected download")
+	}
+
+	// Passing candidates are promoted.
+	dir = t.TempDir()
+	path = filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	d = update(dir, &CanaryConfig{
+		Lookups:      []CanaryLookup{{"81.2.69.160", "country.iso_code", "GB"}},
+		DatabaseType: "GeoIP2-Country",
+	})
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("database not promoted: %v", err)
+	}
+	if _, err := os.Stat(path + candidateSuffix); err == nil {
+		t.Error("candidate left behind")
+	}
+	if !d.hasDBReaders() {
+		t.Error("promoted database not loaded")
+	}
+}
@@ -0,0 +1,469 @@
+package geoip2
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/bits"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// maxChallengeDifficulty bounds the difficulty so a challenge
+// can still be solved by a browser in reasonable time.
+const maxChallengeDifficulty = 32
+
+// GeoIP2Challenge implements the http.handlers.geoip2_challenge middleware.
+// Clients matching one of the rules are served a self-contained JavaScript
+// proof-of-work challenge instead of the requested resource. Solving it
+// issues a signed clearance cookie bound to the client IP address, and
+// cleared clients pass through until the cookie expires.
+//
+// The difficulty is the number of leading zero bits the solution hash
+// must have; the highest difficulty of all matching rules applies, so
+// rules for riskier origins should use higher difficulties. Rules use
+// the variables of the geoip2_vars handler, which must be ordered first.
+type GeoIP2Challenge struct {
+	// Secret signs challenges and clearance cookies. Placeholders are
+	// replaced at provision time. If empty, a random secret is generated,
+	// which invalidates all cookies on every config load.
+	Secret string `json:"secret,omitempty"`
+	// CookieName is the name of the clearance cookie.
+	// Defaults to "geoip2_clearance".
+	CookieName string `json:"cookie_name,omitempty"`
+	// ClearanceTTL is how long a clearance cookie is valid. Defaults to 1h.
+	ClearanceTTL caddy.Duration `json:"clearance_ttl,omitempty"`
+	// ChallengeTTL is how long a challenge can be solved. Defaults to 5m.
+	ChallengeTTL caddy.Duration `json:"challenge_ttl,omitempty"`
+	// Path receives challenge solutions.
+	// Defaults to "/.well-known/geoip2-challenge".
+	Path string `json:"path,omitempty"`
+	// Rules select the clients to challenge.
+	Rules []*ChallengeRule `json:"rules,omitempty"`
+	// OnStale is the policy while geoip2_vars reports a stale
+	// database: "serve" applies the rules as usual (default),
+	// "deny" responds with 503 Service Unavailable and
+	// "challenge" challenges every client at the highest
+	// difficulty of the rules.
+	OnStale string `json:"on_stale,omitempty"`
+
+	secret []byte
+}
+
+// ChallengeRule challenges the clients matching its criteria.
+type ChallengeRule struct {
+	// Difficulty is the number of leading zero bits
+	// required, from 1 to 32. Every bit doubles the
+	// expected work.
+	Difficulty int `json:"difficulty,omitempty"`
+	GeoCriteria
+}
+
+func init() {
+	caddy.RegisterModule(GeoIP2Challenge{})
+	httpcaddyfile.RegisterHandlerDirective("geoip2_challenge", parseChallengeCaddyfile)
+}
+
+// CaddyModule implements caddy.Module.
+func (GeoIP2Challenge) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geoip2_challenge",
+		New: func() caddy.Module { return new(GeoIP2Challenge) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *GeoIP2Challenge) Provision(_ caddy.Context) error {
+	caddy.Log().Named("http.handlers.geoip2_challenge").Debug("provision")
+	if m.CookieName == "" {
+		m.CookieName = "geoip2_clearance"
+	}
+	if m.ClearanceTTL == 0 {
+		m.ClearanceTTL = caddy.Duration(time.Hour)
+	}
+	if m.ChallengeTTL == 0 {
+		m.ChallengeTTL = caddy.Duration(5 * time.Minute)
+	}
+	if m.Path == "" {
+		m.Path = "/.well-known/geoip2-challenge"
+	}
+
+	secret := caddy.NewReplacer().ReplaceAll(m.Secret, "")
+	if secret == "" {
+		caddy.Log().Named("http.handlers.geoip2_challenge").
+			Warn("no secret configured, clearance cookies will not survive config reloads")
+		m.secret = make([]byte, 32)
+		if _, err := rand.Read(m.secret); err != nil {
+			return fmt.Errorf("generating secret: %w", err)
+		}
+	} else {
+		m.secret = []byte(secret)
+	}
+
+	for i, rule := range m.Rules {
+		if err := rule.provision(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (m *GeoIP2Challenge) Validate() error {
+	if len(m.Rules) == 0 {
+		return errors.New("no challenge rules configured")
+	}
+	for i, rule := range m.Rules {
+		if rule.Difficulty < 1 || rule.Difficulty > maxChallengeDifficulty {
+			return fmt.Errorf("rule %d: difficulty must be between 1 and %d: %d", i, maxChallengeDifficulty, rule.Difficulty)
+		}
+		if rule.empty() {
+			return fmt.Errorf("rule %d: no criteria configured", i)
+		}
+	}
+	if !strings.HasPrefix(m.Path, "/") {
+		return fmt.Errorf("path must start with a slash: %q", m.Path)
+	}
+	return validateOnStale(m.OnStale, onStaleChallenge)
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (m *GeoIP2Challenge) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	stale := requestStale(repl)
+	if stale && m.OnStale == onStaleDeny {
+		return caddyhttp.Error(http.StatusServiceUnavailable, errStale)
+	}
+	challengeAll := stale && m.OnStale == onStaleChallenge
+
+	difficulty := 0
+	for _, rule := range m.Rules {
+		if rule.Difficulty > difficulty && (challengeAll || rule.match(repl)) {
+			difficulty = rule.Difficulty
+		}
+	}
+	if difficulty == 0 {
+		return next.ServeHTTP(w, r)
+	}
+
+	clientIP := challengeClientIP(repl, r)
+	now := time.Now()
+	if cookie, err := r.Cookie(m.CookieName); err == nil && m.validClearance(cookie.Value, clientIP, now) {
+		return next.ServeHTTP(w, r)
+	}
+
+	if r.Method == http.MethodPost && r.URL.Path == m.Path {
+		return m.verify(w, r, clientIP, difficulty, now)
+	}
+	return m.serveChallenge(w, r, clientIP, difficulty, now)
+}
+
+// serveChallenge responds with the challenge page.
+func (m *GeoIP2Challenge) serveChallenge(w http.ResponseWriter, r *http.Request, clientIP string, difficulty int, now time.Time) error {
+	challenge, err := m.newChallenge(clientIP, difficulty, now)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	return challengePage.Execute(w, map[string]any{
+		"Action":     m.Path,
+		"Challenge":  challenge,
+		"Difficulty": difficulty,
+		"Redirect":   r.URL.RequestURI(),
+	})
+}
+
+// verify checks a submitted solution and issues a clearance cookie.
+func (m *GeoIP2Challenge) verify(w http.ResponseWriter, r *http.Request, clientIP string, difficulty int, now time.Time) error {
+	challenge := r.PostFormValue("challenge")
+	nonce := r.PostFormValue("nonce")
+	if err := m.checkSolution(challenge, nonce, clientIP, difficulty, now); err != nil {
+		caddy.Log().Named("http.handlers.geoip2_challenge").Debug(
+			"rejected challenge solution",
+			zap.String("clientIP", clientIP),
+			zap.Error(err),
+		)
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+
+	expires := now.Add(time.Duration(m.ClearanceTTL))
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.CookieName,
+		Value:    m.clearance(clientIP, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	redirect := r.PostFormValue("redirect")
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+	return nil
+}
+
+// newChallenge returns a signed challenge of the form
+// "<ip>|<difficulty>|<expiry>|<random>.<signature>".
+func (m *GeoIP2Challenge) newChallenge(clientIP string, difficulty int, now time.Time) (string, error) {
+	random := make([]byte, 12)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("generating challenge: %w", err)
+	}
+	payload := strings.Join([]string{
+		clientIP,
+		strconv.Itoa(difficulty),
+		strconv.FormatInt(now.Add(time.Duration(m.ChallengeTTL)).Unix(), 10),
+		base64.RawURLEncoding.EncodeToString(random),
+	}, "|")
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + m.sign("challenge", encoded), nil
+}
+
+// checkSolution verifies that challenge was issued for clientIP with at
+// least the required difficulty, has not expired, and that nonce solves it.
+func (m *GeoIP2Challenge) checkSolution(challenge, nonce, clientIP string, difficulty int, now time.Time) error {
+	encoded, signature, ok := strings.Cut(challenge, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(m.sign("challenge", encoded))) {
+		return errors.New("invalid challenge signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("decoding challenge: %w", err)
+	}
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 4 {
+		return errors.New("malformed challenge")
+	}
+	if fields[0] != clientIP {
+		return errors.New("challenge was issued for another address")
+	}
+	issued, err := strconv.Atoi(fields[1])
+	if err != nil || issued < difficulty {
+		return errors.New("challenge difficulty too low")
+	}
+	expiry, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || now.Unix() > expiry {
+		return errors.New("challenge expired")
+	}
+	if nonce == "" || len(nonce) > 20 {
+		return errors.New("invalid nonce")
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) < issued {
+		return errors.New("insufficient proof of work")
+	}
+	return nil
+}
+
+// clearance returns a cookie value of the form "<expiry>.<signature>",
+// where the signature covers clientIP and the expiry.
+func (m *GeoIP2Challenge) clearance(clientIP string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + m.sign("clearance", clientIP+"|"+expiry)
+}
+
+func (m *GeoIP2Challenge) validClearance(value, clientIP string, now time.Time) bool {
+	expiry, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	if !hmac.Equal([]byte(signature), []byte(m.sign("clearance", clientIP+"|"+expiry))) {
+		return false
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && now.Unix() <= unix
+}
+
+// sign returns the HMAC-SHA256 of data, separated by purpose
+// so that challenges can not be used as clearances.
+func (m *GeoIP2Challenge) sign(purpose, data string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(purpose + "\x00" + data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// challengeClientIP returns the address resolved by geoip2_vars,
+// or the remote address if it is not set.
+func challengeClientIP(repl *caddy.Replacer, r *http.Request) string {
+	if address, _ := repl.GetString("geoip2.ip_address"); address != "" {
+		return address
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for i := 0; i < len(sum); i += 8 {
+		word := binary.BigEndian.Uint64(sum[i:])
+		n += bits.LeadingZeros64(word)
+		if word != 0 {
+			break
+		}
+	}
+	return n
+}
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Checking your browser</title>
+</head>
+<body>
+<noscript>Please enable JavaScript to continue.</noscript>
+<p id="status">Checking your browser&hellip;</p>
+<form id="solution" method="POST" action="{{.Action}}">
+<input type="hidden" name="challenge" value="{{.Challenge}}">
+<input type="hidden" name="nonce" value="">
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+</form>
+<script>
+(async function () {
+  const challenge = {{.Challenge}};
+  const difficulty = {{.Difficulty}};
+  const encoder = new TextEncoder();
+  function zeroBits(bytes) {
+    let n = 0;
+    for (const b of bytes) {
+      if (b === 0) { n += 8; continue; }
+      return n + Math.clz32(b) - 24;
+    }
+    return n;
+  }
+  for (let nonce = 0; ; nonce++) {
+    const digest = await crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + nonce));
+    if (zeroBits(new Uint8Array(digest)) >= difficulty) {
+      const form = document.getElementById("solution");
+      form.elements.nonce.value = String(nonce);
+      form.submit();
+      return;
+    }
+  }
+})();
+</script>
+</body>
+</html>
+`))
+
+func parseChallengeCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := &GeoIP2Challenge{}
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	geoip2_challenge {
+//	    secret        <secret>
+//	    cookie_name   <name>
+//	    clearance_ttl <duration>
+//	    challenge_ttl <duration>
+//	    path          <path>
+//	    on_stale      serve|deny|challenge
+//	    rule <difficulty> {
+//	        countries    <codes...>
+//	        continents   <codes...>
+//	        subdivisions <codes...>
+//	        asns         <numbers...>
+//	        networks     <cidrs...>
+//	        anonymous    <flags...>
+//	    }
+//	}
+func (m *GeoIP2Challenge) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "secret":
+				if !d.Args(&m.Secret) {
+					return d.ArgErr()
+				}
+			case "cookie_name":
+				if !d.Args(&m.CookieName) {
+					return d.ArgErr()
+				}
+			case "path":
+				if !d.Args(&m.Path) {
+					return d.ArgErr()
+				}
+			case "on_stale":
+				if !d.Args(&m.OnStale) || d.NextArg() {
+					return d.ArgErr()
+				}
+			case "clearance_ttl", "challenge_ttl":
+				key := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid %s: %v", key, err)
+				}
+				if key == "clearance_ttl" {
+					m.ClearanceTTL = caddy.Duration(ttl)
+				} else {
+					m.ChallengeTTL = caddy.Duration(ttl)
+				}
+			case "rule":
+				rule := &ChallengeRule{}
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				difficulty, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("difficulty is not an integer: %v", err)
+				}
+				rule.Difficulty = difficulty
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					ok, err := rule.GeoCriteria.unmarshalCaddyfile(d)
+					if err != nil {
+						return err
+					}
+					if !ok {
+						return d.Errf("unrecognized subdirective %q", d.Val())
+					}
+				}
+				m.Rules = append(m.Rules, rule)
+			default:
+				return d.Errf("unrecognized subdirective %q", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards.
+var (
+	_ caddy.Module                = (*GeoIP2Challenge)(nil)
+	_ caddy.Provisioner           = (*GeoIP2Challenge)(nil)
+	_ caddy.Validator             = (*GeoIP2Challenge)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GeoIP2Challenge)(nil)
+	_ caddyfile.Unmarshaler       = (*GeoIP2Challenge)(nil)
+)
@@ -0,0 +1,123 @@
+package geoip2
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestChallenge(t *testing.T) {
+	m := &GeoIP2Challenge{
+		Secret: "test-secret",
+		Rules: []*ChallengeRule{
+			{Difficulty: 4, GeoCriteria: GeoCriteria{Anonymous: []string{"hosting_provider"}}},
+			{Difficulty: 8, GeoCriteria: GeoCriteria{Anonymous: []string{"tor_exit_node"}}},
+		},
+	}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	risky := map[string]any{
+		"geoip2.ip_address":          "81.2.69.187",
+		"geoip2.is_hosting_provider": true,
+		"geoip2.is_tor_exit_node":    true,
+	}
+
+	// Clients matching no rule pass through.
+	rec := httptest.NewRecorder()
+	if err := m.ServeHTTP(rec, newGeoRequest(map[string]any{"geoip2.ip_address": "81.2.69.160"}), nextHandler); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("unmatched client: status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	// Matching clients get the challenge page with the highest difficulty.
+	rec = httptest.NewRecorder()
+	req := newGeoRequest(risky)
+	req.URL.Path = "/admin"
+	if err := m.ServeHTTP(rec, req, nextHandler); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("challenge: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	body := rec.Body.String()
+	if !regexp.MustCompile(`const difficulty = +8 *;`).MatchString(body) {
+		t.Fatalf("challenge page does not use difficulty 8:\n%s", body)
+	}
+	challenge := regexp.MustCompile(`name="challenge" value="([^"]+)"`).FindStringSubmatch(body)[1]
+
+	// An unsolved challenge is rejected.
+	if err := m.ServeHTTP(httptest.NewRecorder(), solutionRequest(risky, challenge, ""), nextHandler); err == nil {
+		t.Fatal("expected a missing solution to be rejected")
+	}
+
+	nonce := solveChallenge(challenge, 8)
+	rec = httptest.NewRecorder()
+	if err := m.ServeHTTP(rec, solutionRequest(risky, challenge, nonce), nextHandler); err != nil {
+		t.Fatalf("verifying solution: %v", err)
+	}
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/admin" {
+		t.Fatalf("solution: status %d, location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "geoip2_clearance" {
+		t.Fatalf("expected a clearance cookie, got %v", cookies)
+	}
+
+	// The clearance cookie lets the client pass ...
+	req = newGeoRequest(risky)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	if err := m.ServeHTTP(rec, req, nextHandler); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("cleared client: status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	// ... but only from the address it was issued to.
+	other := map[string]any{"geoip2.ip_address": "81.2.69.188", "geoip2.is_tor_exit_node": true}
+	req = newGeoRequest(other)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	if err := m.ServeHTTP(rec, req, nextHandler); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("cookie from another address: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	// A challenge issued for one address can not be solved from another.
+	if err := m.ServeHTTP(httptest.NewRecorder(), solutionRequest(other, challenge, nonce), nextHandler); err == nil {
+		t.Fatal("expected a challenge of another address to be rejected")
+	}
+}
+
+func solutionRequest(vars map[string]any, challenge, nonce string) *http.Request {
+	form := url.Values{"challenge": {challenge}, "nonce": {nonce}, "redirect": {"/admin"}}
+	req := httptest.NewRequest(http.MethodPost, "/.well-known/geoip2-challenge", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req.WithContext(newGeoRequest(vars).Context())
+}
+
+func solveChallenge(challenge string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		n := strconv.Itoa(nonce)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+n))) >= difficulty {
+			return n
+		}
+	}
+}
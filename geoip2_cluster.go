@@ -0,0 +1,119 @@
+package geoip2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// clusterMeta describes a database published to the cluster storage.
+type clusterMeta struct {
+	// MD5 is the checksum of the published database file.
+	MD5 string `json:"md5"`
+	// ETag is the entity tag the source sent with the file, if any.
+	ETag string `json:"etag,omitempty"`
+	// Checked is when a node last checked the source for updates.
+	Checked time.Time `json:"checked"`
+}
+
+// cluster shares the databases of a configuration between the
+// nodes using the same storage. Storage locks make one node at a
+// time check the source of a database; the others wait for it and
+// take the database it published over.
+type cluster struct {
+	storage certmagic.Storage
+	// prefix is the storage key of the configuration.
+	prefix string
+}
+
+// newCluster returns the cluster of the instance name in storage.
+func newCluster(storage certmagic.Storage, name string) *cluster {
+	prefix := moduleName
+	if name != "" {
+		prefix = path.Join(prefix, "instances", name)
+	}
+	return &cluster{storage: storage, prefix: prefix}
+}
+
+func (c *cluster) key(db *DatabaseConfig, suffix string) string {
+	return path.Join(c.prefix, db.Name+suffix)
+}
+
+// lock acquires the storage lock of db, blocking until the
+// node holding it releases it or ctx is done.
+func (c *cluster) lock(ctx context.Context, db *DatabaseConfig) (unlock func(), err error) {
+	name := c.key(db, "")
+	if err := c.storage.Lock(ctx, name); err != nil {
+		return nil, fmt.Errorf("locking %s in storage: %w", name, err)
+	}
+	return func() {
+		// The lock is released even if ctx is done.
+		c.storage.Unlock(context.WithoutCancel(ctx), name)
+	}, nil
+}
+
+// meta returns the metadata of the published db, or nil if
+// it has not been published.
+func (c *cluster) meta(ctx context.Context, db *DatabaseConfig) (*clusterMeta, error) {
+	data, err := c.storage.Load(ctx, c.key(db, ".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading database metadata from storage: %w", err)
+	}
+	meta := new(clusterMeta)
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("decoding database metadata from storage: %w", err)
+	}
+	return meta, nil
+}
+
+// pull writes the published db described by meta to candidate.
+func (c *cluster) pull(ctx context.Context, db *DatabaseConfig, meta *clusterMeta, candidate string) error {
+	data, err := c.storage.Load(ctx, c.key(db, ".mmdb"))
+	if err != nil {
+		return fmt.Errorf("loading database from storage: %w", err)
+	}
+	if err := os.WriteFile(candidate, data, 0o644); err != nil {
+		return err
+	}
+	sum, err := fileMD5(candidate)
+	if err == nil && sum != meta.MD5 {
+		err = fmt.Errorf("md5 of the database in storage (%s) does not match its metadata (%s)", sum, meta.MD5)
+	}
+	if err != nil {
+		os.Remove(candidate)
+		return err
+	}
+	return nil
+}
+
+// publish stores the database file of db, unless it is published
+// already, and then its metadata.
+func (c *cluster) publish(ctx context.Context, db *DatabaseConfig, previous, meta *clusterMeta) error {
+	if previous == nil || previous.MD5 != meta.MD5 {
+		data, err := os.ReadFile(db.Path)
+		if err != nil {
+			return err
+		}
+		if err := c.storage.Store(ctx, c.key(db, ".mmdb"), data); err != nil {
+			return fmt.Errorf("storing database: %w", err)
+		}
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := c.storage.Store(ctx, c.key(db, ".json"), data); err != nil {
+		return fmt.Errorf("storing database metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package geoip2
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestClusterDistribution(t *testing.T) {
+	var requests atomic.Int64
+	srv := newUpdateServer(t, &requests)
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	// run runs the updater of a node once. Nodes with credentials
+	// download from MaxMind, the others only take databases over.
+	run := func(credentials bool) *databases {
+		dir := t.TempDir()
+		cfg := GeoIP2State{
+			DatabaseDirectory: dir,
+			LockFile:          filepath.Join(dir, "geoip2.lock"),
+			EditionIDs:        []string{"GeoIP2-Country-Test"},
+			UpdateURL:         srv.URL,
+			Cluster:           true,
+		}
+		if credentials {
+			cfg.AccountID, cfg.LicenseKey = 1, "key"
+		}
+		d := newDatabases(cfg)
+		d.cluster.Store(newCluster(storage, ""))
+		t.Cleanup(func() { d.Destruct() })
+		d.wg.Add(1)
+		d.runGeoIPUpdate()
+		return d
+	}
+
+	downloader := run(true)
+	if requests.Load() != 1 || !downloader.hasDBReaders() {
+		t.Fatalf("database not downloaded, got %d requests", requests.Load())
+	}
+	meta, err := newCluster(storage, "").meta(context.Background(), downloader.configs[0])
+	if err != nil || meta == nil {
+		t.Fatalf("database not published: %v", err)
+	}
+	sum, err := fileMD5(downloader.configs[0].Path)
+	if err != nil || meta.MD5 != sum {
+		t.Errorf("published md5 %s, want %s: %v", meta.MD5, sum, err)
+	}
+
+	// Other nodes take the published database over without checking
+	// MaxMind themselves, whether they have credentials or not.
+	for _, credentials := range []bool{false, true} {
+		d := run(credentials)
+		if !d.hasDBReaders() {
+			t.Errorf("database not taken over by a node with credentials %v", credentials)
+		}
+	}
+	if requests.Load() != 1 {
+		t.Errorf("got %d requests, want the downloader's only", requests.Load())
+	}
+
+	// Instances are kept apart.
+	if meta, err := newCluster(storage, "other").meta(context.Background(), downloader.configs[0]); err != nil || meta != nil {
+		t.Errorf("database published for another instance: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package geoip2
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// anonymousFlags maps the names accepted by GeoCriteria.Anonymous
+// to the variables set by the geoip2_vars handler.
+var anonymousFlags = map[string]string{
+	"anonymous":         "geoip2.is_anonymous",
+	"anonymous_vpn":     "geoip2.is_anonymous_vpn",
+	"hosting_provider":  "geoip2.is_hosting_provider",
+	"public_proxy":      "geoip2.is_public_proxy",
+	"residential_proxy": "geoip2.is_residential_proxy",
+	"tor_exit_node":     "geoip2.is_tor_exit_node",
+}
+
+// GeoCriteria selects requests by the variables of the geoip2_vars
+// handler, which must therefore run first. A request matches if any
+// of the configured values matches.
+type GeoCriteria struct {
+	// Countries are ISO 3166-1 country codes, e.g. "GB".
+	Countries []string `json:"countries,omitempty"`
+	// Continents are continent codes, e.g. "EU".
+	Continents []string `json:"continents,omitempty"`
+	// Subdivisions are ISO 3166-2 subdivision codes, e.g. "GB-ENG".
+	Subdivisions []string `json:"subdivisions,omitempty"`
+	// ASNs are autonomous system numbers.
+	ASNs []uint `json:"asns,omitempty"`
+	// Networks are CIDR ranges the client address is matched against.
+	Networks []string `json:"networks,omitempty"`
+	// Anonymous lists anonymity flags of the Anonymous-IP database:
+	// anonymous, anonymous_vpn, hosting_provider, public_proxy,
+	// residential_proxy and tor_exit_node.
+	Anonymous []string `json:"anonymous,omitempty"`
+
+	networks []*net.IPNet
+}
+
+// provision parses the configured networks.
+func (c *GeoCriteria) provision() error {
+	c.networks = nil
+	for _, cidr := range c.Networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("parsing network: %w", err)
+		}
+		c.networks = append(c.networks, network)
+	}
+	for _, flag := range c.Anonymous {
+		if _, ok := anonymousFlags[flag]; !ok {
+			return fmt.Errorf("unknown anonymity flag: %q", flag)
+		}
+	}
+	return nil
+}
+
+// empty reports whether no criteria are configured.
+func (c *GeoCriteria) empty() bool {
+	return len(c.Countries) == 0 && len(c.Continents) == 0 && len(c.Subdivisions) == 0 &&
+		len(c.ASNs) == 0 && len(c.Networks) == 0 && len(c.Anonymous) == 0
+}
+
+// match reports whether the request variables in repl match any criterion.
+func (c *GeoCriteria) match(repl *caddy.Replacer) bool {
+	if len(c.Countries) > 0 {
+		country, _ := repl.GetString("geoip2.country_code")
+		if containsFold(c.Countries, country) {
+			return true
+		}
+	}
+	if len(c.Continents) > 0 {
+		continent, _ := repl.GetString("geoip2.continent_code")
+		if containsFold(c.Continents, continent) {
+			return true
+		}
+	}
+	if len(c.Subdivisions) > 0 {
+		country, _ := repl.GetString("geoip2.country_code")
+		subdivision, _ := repl.GetString("geoip2.subdivisions_1_iso_code")
+		if country != "" && subdivision != "" && containsFold(c.Subdivisions, country+"-"+subdivision) {
+			return true
+		}
+	}
+	if len(c.ASNs) > 0 {
+		if asn, err := strconv.ParseUint(asnValue(repl), 10, 0); err == nil && slices.Contains(c.ASNs, uint(asn)) {
+			return true
+		}
+	}
+	if len(c.networks) > 0 {
+		address, _ := repl.GetString("geoip2.ip_address")
+		if ip := net.ParseIP(address); ip != nil {
+			for _, network := range c.networks {
+				if network.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	for _, flag := range c.Anonymous {
+		if value, _ := repl.GetString(anonymousFlags[flag]); value == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// unmarshalCaddyfile parses the criterion subdirective at the current
+// position of d. It reports false if the subdirective is not a criterion.
+//
+//	countries    <codes...>
+//	continents   <codes...>
+//	subdivisions <codes...>
+//	asns         <numbers...>
+//	networks     <cidrs...>
+//	anonymous    <flags...>
+func (c *GeoCriteria) unmarshalCaddyfile(d *caddyfile.Dispenser) (bool, error) {
+	key := d.Val()
+	var target *[]string
+	switch key {
+	case "countries":
+		target = &c.Countries
+	case "continents":
+		target = &c.Continents
+	case "subdivisions":
+		target = &c.Subdivisions
+	case "networks":
+		target = &c.Networks
+	case "anonymous":
+		target = &c.Anonymous
+	case "asns":
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return true, d.ArgErr()
+		}
+		for _, arg := range args {
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(arg), "AS"), 10, 0)
+			if err != nil {
+				return true, d.Errf("invalid autonomous system number %q: %v", arg, err)
+			}
+			c.ASNs = append(c.ASNs, uint(asn))
+		}
+		return true, nil
+	default:
+		return false, nil
+	}
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return true, d.ArgErr()
+	}
+	*target = append(*target, args...)
+	return true, nil
+}
+
+// asnValue returns the autonomous system number of the current
+// request from either an ASN/ISP or an Enterprise database.
+func asnValue(repl *caddy.Replacer) string {
+	for _, key := range []string{"geoip2.autonomous_system_number", "geoip2.traits_autonomous_system_number"} {
+		if value, _ := repl.GetString(key); value != "" && value != "0" {
+			return value
+		}
+	}
+	return ""
+}
+
+func containsFold(values []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
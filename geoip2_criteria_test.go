@@ -0,0 +1,51 @@
+package geoip2
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestGeoCriteriaMatch(t *testing.T) {
+	c := &GeoCriteria{
+		Countries:    []string{"us"},
+		Subdivisions: []string{"GB-ENG"},
+		ASNs:         []uint{1221},
+		Networks:     []string{"10.0.0.0/8", "2001:db8::/32"},
+		Anonymous:    []string{"tor_exit_node"},
+	}
+	if err := c.provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		vars  map[string]any
+		match bool
+	}{
+		{map[string]any{"geoip2.country_code": "US"}, true},
+		{map[string]any{"geoip2.country_code": "GB"}, false},
+		{map[string]any{"geoip2.country_code": "GB", "geoip2.subdivisions_1_iso_code": "ENG"}, true},
+		{map[string]any{"geoip2.country_code": "GB", "geoip2.subdivisions_1_iso_code": "SCT"}, false},
+		{map[string]any{"geoip2.autonomous_system_number": uint(1221)}, true},
+		{map[string]any{"geoip2.traits_autonomous_system_number": uint(1221)}, true},
+		{map[string]any{"geoip2.autonomous_system_number": uint(0)}, false},
+		{map[string]any{"geoip2.ip_address": "10.1.2.3"}, true},
+		{map[string]any{"geoip2.ip_address": "2001:db8::1"}, true},
+		{map[string]any{"geoip2.ip_address": "192.0.2.1"}, false},
+		{map[string]any{"geoip2.is_tor_exit_node": true}, true},
+		{map[string]any{"geoip2.is_tor_exit_node": false}, false},
+		{map[string]any{}, false},
+	} {
+		repl := caddy.NewEmptyReplacer()
+		for key, value := range tc.vars {
+			repl.Set(key, value)
+		}
+		if got := c.match(repl); got != tc.match {
+			t.Errorf("match(%v) = %v, want %v", tc.vars, got, tc.match)
+		}
+	}
+
+	if err := (&GeoCriteria{Anonymous: []string{"bogus"}}).provision(); err == nil {
+		t.Error("expected an error for an unknown anonymity flag")
+	}
+}
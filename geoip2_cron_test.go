@@ -0,0 +1,49 @@
+package geoip2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2025, 6, 3, 10, 30, 0, 0, time.UTC) // a Tuesday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, 6, 3, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 6, 3, 10, 45, 0, 0, time.UTC)},
+		{"0 3 * * 2,5", time.Date(2025, 6, 6, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2025, 6, 8, 3, 0, 0, 0, time.UTC)},
+		{"30 10 * * tue", time.Date(2025, 6, 10, 10, 30, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2025, 7, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Restricted days of the month and week match either.
+		{"0 0 15 * fri", time.Date(2025, 6, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 9-17/4 * * mon-fri", time.Date(2025, 6, 3, 13, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2025, 6, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got := s.next(from); !got.Equal(tt.want) {
+			t.Errorf("%s: next %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+
+	// Times skipped by daylight saving time are not matched.
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, _ := parseCron("30 2 * * *")
+	got := s.next(time.Date(2025, 3, 30, 0, 0, 0, 0, berlin))
+	if want := time.Date(2025, 3, 31, 2, 30, 0, 0, berlin); !got.Equal(want) {
+		t.Errorf("next %s, want %s", got, want)
+	}
+}
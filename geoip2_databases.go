@@ -0,0 +1,666 @@
+package geoip2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate/database"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/zhangjiayin/caddy-geoip2/replacer"
+	"go.uber.org/zap"
+)
+
+// databasesPool shares the databases between config loads,
+// keyed by the JSON encoding of the geoip2 configuration.
+var databasesPool = caddy.NewUsagePool()
+
+// databases holds the database readers and the updater of a geoip2
+// configuration. Config reloads that keep the geoip2 configuration
+// take the loaded databases over instead of opening and downloading
+// them again.
+type databases struct {
+	cfg GeoIP2State
+	// configs are the databases in lookup order.
+	configs []*DatabaseConfig
+
+	// readers is the current snapshot of database readers.
+	// It is swapped atomically and never modified in place.
+	readers atomic.Pointer[readerSet]
+	// mu serializes updates of the reader set.
+	mu sync.Mutex
+	// filesMu serializes replacements of the database files
+	// and changes of their versions.
+	filesMu sync.Mutex
+
+	// started ensures that the databases are loaded and
+	// updated only by the first configuration using them.
+	started  sync.Once
+	startErr error
+
+	// done and wg are used to exit gracefully
+	// and wait for any update to complete first.
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// cluster shares the databases through the storage of the latest
+	// configuration using them, if the configuration enables it.
+	cluster atomic.Pointer[cluster]
+	// events emits events through the events app of the latest
+	// configuration using the databases, if it has one.
+	events atomic.Pointer[eventEmitter]
+
+	// stale holds the loaded databases older than their max age,
+	// and anyStale whether there are any.
+	staleMu  sync.Mutex
+	stale    map[string]bool
+	anyStale atomic.Bool
+
+	// ready is closed once all configured editions are loaded.
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+func newDatabases(cfg GeoIP2State) *databases {
+	return &databases{
+		cfg:     cfg,
+		configs: cfg.databaseConfigs(),
+		done:    make(chan struct{}),
+		ready:   make(chan struct{}),
+	}
+}
+
+// start loads the databases and starts the updater,
+// unless a previous configuration already did.
+func (d *databases) start() error {
+	d.started.Do(func() {
+		// Offline databases are only loaded, so nothing is created.
+		if d.cfg.Offline {
+			d.wg.Add(1)
+		} else {
+			if d.startErr = d.ensureDirectories(); d.startErr != nil {
+				return
+			}
+			d.wg.Add(2)
+			go d.runGeoIPUpdate()
+		}
+		go func() {
+			defer d.wg.Done()
+			d.loadGeoIPReaders()
+		}()
+		if slices.ContainsFunc(d.configs, func(db *DatabaseConfig) bool { return db.MaxAge > 0 }) {
+			d.wg.Add(1)
+			go d.watchStaleness()
+		}
+		if d.cfg.WatchDatabases {
+			// The directory is watched before start returns,
+			// so that no change after start is missed.
+			watcher := d.newFileWatcher()
+			d.wg.Add(1)
+			go d.watchDatabases(watcher)
+		}
+	})
+	return d.startErr
+}
+
+// Destruct implements caddy.Destructor. It is called once the
+// last configuration using the databases has been cleaned up.
+func (d *databases) Destruct() error {
+	close(d.done)
+	d.wg.Wait()
+
+	// The readers are closed once in-flight lookups have finished.
+	caddy.Log().Named(moduleName).Debug("retiring geoip database readers")
+	d.mu.Lock()
+	d.swapReaders(nil)
+	d.mu.Unlock()
+	d.retireStaleSeries()
+	return nil
+}
+
+// waitForDatabases blocks until all editions are loaded or the timeout expires.
+func (d *databases) waitForDatabases(timeout time.Duration) error {
+	caddy.Log().Named(moduleName).Info("waiting for geoip databases", zap.Duration("timeout", timeout))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-d.ready:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("geoip databases not loaded within %s: missing %s",
+			timeout, strings.Join(d.missingDatabases(), ", "))
+	}
+}
+
+func (d *databases) lookup(repl *caddy.Replacer, clientIP net.IP) {
+	s := d.acquireReaders()
+	if s == nil {
+		return
+	}
+	defer s.release()
+	for _, r := range s.readers {
+		r.Lookup(repl, clientIP)
+	}
+}
+
+// record returns the raw database records for clientIP merged
+// across all loaded databases.
+func (d *databases) record(clientIP net.IP) (map[string]any, error) {
+	merged := map[string]any{}
+	s := d.acquireReaders()
+	if s == nil {
+		return merged, nil
+	}
+	defer s.release()
+	for _, r := range s.readers {
+		record, err := r.Record(clientIP)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(merged, record)
+	}
+	return merged, nil
+}
+
+// loadGeoIPReaders loads the database files into a new reader set.
+// Readers of unchanged files are carried over, and the previous reader
+// of a database is kept if its new file cannot be loaded.
+func (d *databases) loadGeoIPReaders() {
+	caddy.Log().Named(moduleName).Debug("load geoip readers")
+	d.mu.Lock()
+
+	// The current set stays referenced by the databases until it is
+	// swapped below, so its readers remain open while they are reused.
+	current := d.readers.Load()
+	var dbReaders []*dbReader
+	var loaded []func()
+	for _, db := range d.configs {
+		previous := current.reader(db.Name)
+		info, err := os.Stat(db.Path)
+		if err == nil && previous != nil && previous.stamp == newFileStamp(info) {
+			previous.retain()
+			dbReaders = append(dbReaders, previous)
+			continue
+		}
+
+		var reader *dbReader
+		if err == nil {
+			reader, err = d.openDatabase(db, info, previous)
+		}
+		switch {
+		case err != nil && previous != nil:
+			caddy.Log().Named(moduleName).Error("rejected geoip database file, keeping previous reader",
+				zap.String("database", db.Name), zap.String("path", db.Path), zap.Error(err))
+			previous.retain()
+			dbReaders = append(dbReaders, previous)
+		case errors.Is(err, fs.ErrNotExist):
+			caddy.Log().Named(moduleName).
+				Error("missing geoip database file", zap.String("database", db.Name), zap.String("path", db.Path))
+		case err != nil:
+			caddy.Log().Named(moduleName).
+				Error("initializing geoip database reader", zap.String("database", db.Name), zap.Error(err))
+		default:
+			caddy.Log().Named(moduleName).
+				Info("initialized geoip database reader", zap.String("database", db.Name))
+			dbReaders = append(dbReaders, reader)
+			meta := reader.Metadata()
+			loaded = append(loaded, func() {
+				d.emit(eventDatabaseLoaded, db, map[string]any{
+					"build_epoch":   meta.BuildEpoch,
+					"database_type": meta.DatabaseType,
+				})
+			})
+		}
+	}
+
+	d.swapReaders(newReaderSet(dbReaders))
+	d.mu.Unlock()
+	// Event handlers run after the lock is released,
+	// so that they may reload the databases.
+	for _, emit := range loaded {
+		emit()
+	}
+	d.checkStaleness(time.Now())
+}
+
+// openDatabase opens and verifies the file of db, described by info.
+// The file is rejected if its database type differs from the one of
+// previous, the loaded reader of db, which may be nil.
+func (d *databases) openDatabase(db *DatabaseConfig, info fs.FileInfo, previous *dbReader) (*dbReader, error) {
+	r, err := replacer.NewVerified(db.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDatabaseType(r, previous); err != nil {
+		r.Close()
+		return nil, err
+	}
+	reader := newDBReader(db.Name, r)
+	reader.stamp = newFileStamp(info)
+	return reader, nil
+}
+
+// checkDatabaseType rejects r if its database type differs
+// from the one of previous, which may be nil.
+func checkDatabaseType(r replacer.Replacer, previous *dbReader) error {
+	if previous == nil {
+		return nil
+	}
+	got, want := r.Metadata().DatabaseType, previous.Metadata().DatabaseType
+	if got != want {
+		return fmt.Errorf("database type %q differs from the loaded %q", got, want)
+	}
+	return nil
+}
+
+// promoteCandidate checks the downloaded candidate file of db and moves
+// it into place if it passes. Otherwise the candidate is kept aside for
+// inspection and the current database file stays in place. If db keeps
+// versions, the candidate and the replaced file are added to them, and
+// a pinned database file is not replaced. The manifest and signature
+// of verified databases are fetched with client.
+func (d *databases) promoteCandidate(ctx context.Context, db *DatabaseConfig, candidate string, client *http.Client) error {
+	// Verification may fetch files, so it runs before the lock is taken.
+	if err := db.Verify.verify(ctx, client, db, candidate); err != nil {
+		err = fmt.Errorf("verifying database: %w", err)
+		if rerr := os.Rename(candidate, db.Path+rejectedSuffix); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+		return err
+	}
+
+	d.filesMu.Lock()
+	defer d.filesMu.Unlock()
+
+	s := d.acquireReaders()
+	if s != nil {
+		defer s.release()
+	}
+	previous := s.reader(db.Name)
+	var loaded *maxminddb.Metadata
+	if previous != nil {
+		meta := previous.Metadata()
+		loaded = &meta
+	}
+
+	r, err := replacer.NewVerified(candidate)
+	if err == nil {
+		err = checkDatabaseType(r, previous)
+		if err == nil {
+			err = db.Canary.check(r, loaded)
+		}
+		r.Close()
+	}
+	if err != nil {
+		if rerr := os.Rename(candidate, db.Path+rejectedSuffix); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+		return err
+	}
+
+	if db.KeepVersions > 0 {
+		var errs []error
+		if _, err := os.Stat(db.Path); err == nil {
+			errs = append(errs, keepVersion(db, db.Path))
+		}
+		errs = append(errs, keepVersion(db, candidate), pruneVersions(db))
+		if err := errors.Join(errs...); err != nil {
+			caddy.Log().Named(moduleName).Error("keeping database versions",
+				zap.String("database", db.Name), zap.Error(err))
+		}
+	}
+	if pinned, err := pinnedVersion(db); err != nil || pinned != 0 {
+		os.Remove(candidate)
+		return err
+	}
+	return os.Rename(candidate, db.Path)
+}
+
+// markReady marks the databases ready once all required databases are loaded.
+func (d *databases) markReady() {
+	if len(d.missingDatabases()) == 0 {
+		d.readyOnce.Do(func() { close(d.ready) })
+	}
+}
+
+// missingDatabases returns the required databases without a loaded reader.
+func (d *databases) missingDatabases() []string {
+	loaded := map[string]bool{}
+	if s := d.readers.Load(); s != nil {
+		for _, r := range s.readers {
+			loaded[r.name] = true
+		}
+	}
+	var missing []string
+	for _, db := range d.configs {
+		if db.Required && !loaded[db.Name] {
+			missing = append(missing, db.Name)
+		}
+	}
+	return missing
+}
+
+// isReady reports whether all required databases have been loaded.
+func (d *databases) isReady() bool {
+	select {
+	case <-d.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *databases) runGeoIPUpdate() {
+	defer d.wg.Done()
+	sources := make(map[string]Source)
+	for _, db := range d.configs {
+		if src := d.source(db); src != nil {
+			sources[db.Name] = src
+		}
+	}
+	// In a cluster, nodes without a source take the databases over.
+	if len(sources) == 0 && !d.cfg.Cluster {
+		return
+	}
+	// Downloads are cancelled once no configuration uses the databases,
+	// including when Caddy stops; reloads keep them running.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-d.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	client, err := d.cfg.UpdateTransport.client()
+	if err != nil {
+		caddy.Log().Named(moduleName).Error("configuring update transport, not updating", zap.Error(err))
+		return
+	}
+
+	// The update schedule is persisted, so that restarts only
+	// download databases which are missing or due.
+	var splay time.Duration
+	if d.cfg.UpdateSplay > 0 {
+		splay = rand.N(time.Duration(d.cfg.UpdateSplay))
+	}
+	schedules := make(map[string]*updateSchedule)
+	periodic := make(map[string]*updateSchedule)
+	for _, db := range d.configs {
+		if sources[db.Name] == nil && !d.cfg.Cluster {
+			continue
+		}
+		sched, err := d.cfg.updateSchedule(db, splay)
+		if err != nil {
+			caddy.Log().Named(moduleName).Error("invalid update schedule, not updating",
+				zap.String("database", db.Name), zap.Error(err))
+			continue
+		}
+		schedules[db.Name] = sched
+		if sched.periodic() {
+			periodic[db.Name] = sched
+		}
+	}
+	statePath := filepath.Join(d.cfg.DatabaseDirectory, updateStateFile)
+	state, err := loadUpdateState(statePath)
+	if err != nil {
+		caddy.Log().Named(moduleName).Error("loading update state", zap.Error(err))
+	}
+	// stale holds the databases that missed a scheduled update,
+	// so that they are reported once until they are updated.
+	stale := make(map[string]bool)
+
+	update := func() {
+		caddy.Log().Named(moduleName).Debug("update geoip databases")
+		now := time.Now()
+		var updated bool
+		for _, db := range d.configs {
+			src, sched := sources[db.Name], schedules[db.Name]
+			if sched == nil {
+				continue
+			}
+			if pinned, err := pinnedVersion(db); err != nil || pinned != 0 {
+				caddy.Log().Named(moduleName).Debug("database pinned, not updating",
+					zap.String("database", db.Name), zap.Uint("build_epoch", pinned), zap.Error(err))
+				continue
+			}
+			if !state.due(db.Name, db.Path, sched, now) {
+				caddy.Log().Named(moduleName).Debug("database file not due for update", zap.String("database", db.Name))
+				continue
+			}
+			ds := state.database(db.Name)
+			failures := ds.Failures
+			d.emit(eventUpdateStarted, db, nil)
+			changed := d.updateDatabase(ctx, db, src, sched, ds, client, now)
+			if changed {
+				updated = true
+				d.emitUpdated(db, ds.MD5)
+			}
+			if ds.Failures <= failures {
+				delete(stale, db.Name)
+				continue
+			}
+			d.emit(eventUpdateFailed, db, map[string]any{"error": ds.LastError, "failures": ds.Failures})
+			// A loaded database is stale once its last successful
+			// check is older than the update interval.
+			regular := &databaseUpdateState{LastCheck: ds.LastSuccess}
+			if !stale[db.Name] && d.readers.Load().reader(db.Name) != nil && !sched.next(regular, now).After(now) {
+				stale[db.Name] = true
+				data := map[string]any{"reason": staleMissedUpdate}
+				if !ds.LastSuccess.IsZero() {
+					data["last_success"] = ds.LastSuccess
+				}
+				d.emit(eventDatabaseStale, db, data)
+			}
+		}
+		if err := state.save(statePath); err != nil {
+			caddy.Log().Named(moduleName).Error("saving update state", zap.Error(err))
+		}
+		if updated {
+			d.loadGeoIPReaders()
+		}
+	}
+
+	// run the update at least once to download missing
+	// database files the first time.
+	update()
+
+	if len(periodic) > 0 {
+		timer := time.NewTimer(state.next(periodic, time.Now()))
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				update()
+				timer.Reset(state.next(periodic, time.Now()))
+			case <-d.done:
+				return
+			}
+		}
+	}
+}
+
+// updateDatabase checks src for an update of db and replaces its file
+// with a newer version that passes its checks. It records the check in
+// ds and reports whether the database file changed.
+//
+// In a cluster, the database another node published is taken over
+// first. The source is only checked if no node checked it within the
+// schedule of the database, and the result is then published. src is
+// nil on nodes that only take the database over.
+func (d *databases) updateDatabase(ctx context.Context, db *DatabaseConfig, src Source, sched *updateSchedule,
+	ds *databaseUpdateState, client *http.Client, now time.Time,
+) bool {
+	logger := caddy.Log().Named(moduleName).
+		With(zap.String("database", db.Name), zap.String("editionID", db.EditionID))
+	ds.LastCheck = now
+
+	oldMD5, err := fileMD5(db.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		oldMD5, err = database.ZeroMD5, nil
+	}
+	if err != nil {
+		ds.failed(err)
+		logger.Error("hashing database file", zap.Error(err))
+		return false
+	}
+	// The database is downloaded to a candidate file,
+	// which replaces the database file once it passed its checks.
+	candidate := db.Path + candidateSuffix
+	os.Remove(candidate)
+	// The entity tag is only valid for the file it was sent with.
+	currentMD5, etag := oldMD5, ds.ETag
+	if ds.MD5 != oldMD5 {
+		etag = ""
+	}
+
+	c := d.cluster.Load()
+	var published *clusterMeta
+	if c != nil {
+		unlock, err := c.lock(ctx, db)
+		if err != nil {
+			ds.failed(err)
+			logger.Error("locking database in storage", zap.Error(err))
+			return false
+		}
+		defer unlock()
+		if published, err = c.meta(ctx, db); err != nil {
+			ds.failed(err)
+			logger.Error("checking database in storage", zap.Error(err))
+			return false
+		}
+		if published != nil && published.MD5 != oldMD5 {
+			err := c.pull(ctx, db, published, candidate)
+			if err == nil {
+				err = d.promoteCandidate(ctx, db, candidate, client)
+			}
+			if err != nil {
+				ds.failed(err)
+				logger.Error("taking database over from storage", zap.Error(err))
+				return false
+			}
+			logger.Info("took database over from storage")
+			currentMD5, etag = published.MD5, published.ETag
+		}
+		fresh := published != nil && sched.next(&databaseUpdateState{LastCheck: published.Checked}, now).After(now)
+		if fresh || src == nil {
+			ds.LastSuccess, ds.MD5, ds.ETag, ds.LastError, ds.Failures = now, currentMD5, etag, "", 0
+			return currentMD5 != oldMD5
+		}
+	}
+
+	result, err := src.Download(ctx, SourceRequest{
+		Database:   db.Name,
+		EditionID:  db.EditionID,
+		Current:    db.Path,
+		CurrentMD5: currentMD5,
+		ETag:       etag,
+		Candidate:  candidate,
+		LockFile:   d.cfg.LockFile,
+		Client:     client,
+	})
+	if err != nil {
+		ds.failed(err)
+		logger.Error("downloading new database file", zap.Error(err))
+		return currentMD5 != oldMD5
+	}
+	if result.Downloaded {
+		if err := d.promoteCandidate(ctx, db, candidate, client); err != nil {
+			ds.failed(err)
+			logger.Error("rejected downloaded database file, keeping previous version",
+				zap.String("rejected", db.Path+rejectedSuffix), zap.Error(err))
+			return currentMD5 != oldMD5
+		}
+	}
+	newMD5, err := fileMD5(db.Path)
+	if err != nil {
+		ds.failed(err)
+		logger.Error("hashing database file", zap.Error(err))
+		return currentMD5 != oldMD5
+	}
+	ds.LastSuccess, ds.MD5, ds.ETag, ds.LastError, ds.Failures = now, newMD5, result.ETag, "", 0
+	if c != nil {
+		meta := &clusterMeta{MD5: newMD5, ETag: result.ETag, Checked: now}
+		if err := c.publish(ctx, db, published, meta); err != nil {
+			logger.Error("publishing database to storage", zap.Error(err))
+		} else if published == nil || published.MD5 != newMD5 {
+			logger.Info("published database to storage")
+		}
+	}
+	if newMD5 == oldMD5 {
+		logger.Debug("database file up to date")
+		return false
+	}
+	logger.Info("updated database file")
+	return true
+}
+
+// source returns the source db is downloaded from, or nil if it is not
+// updated. Databases with an edition ID are downloaded from MaxMind
+// by default if the app has MaxMind credentials.
+func (d *databases) source(db *DatabaseConfig) Source {
+	if db.source != nil {
+		return db.source
+	}
+	if db.EditionID == "" || d.cfg.AccountID <= 0 || d.cfg.LicenseKey == "" {
+		return nil
+	}
+	src := &MaxMindSource{EditionID: db.EditionID}
+	src.inherit(&d.cfg)
+	return src
+}
+
+func (d *databases) hasDBReaders() bool {
+	s := d.readers.Load()
+	return s != nil && len(s.readers) > 0
+}
+
+func (d *databases) ensureDirectories() error {
+	// Create the database directory if needed
+	if err := mkdirIfMissing(d.cfg.DatabaseDirectory); err != nil {
+		return fmt.Errorf("ensuring database directory %q: %w", d.cfg.DatabaseDirectory, err)
+	}
+
+	// Create the directories of database files stored elsewhere
+	for _, db := range d.configs {
+		dir := filepath.Dir(db.Path)
+		if err := mkdirIfMissing(dir); err != nil {
+			return fmt.Errorf("ensuring directory %q of database %q: %w", dir, db.Name, err)
+		}
+	}
+
+	// Create the lock file directory if needed
+	lockFileDir := filepath.Dir(d.cfg.LockFile)
+
+	if err := mkdirIfMissing(lockFileDir); err != nil {
+		return fmt.Errorf("ensuring lock file directory %q: %w", lockFileDir, err)
+	}
+
+	return nil
+}
+
+func mkdirIfMissing(path string) error {
+	if path == "" {
+		// If the folder path is empty, we can't create it
+		return nil
+	}
+
+	return os.MkdirAll(path, 0o700)
+}
+
+// Interface guards.
+var _ caddy.Destructor = (*databases)(nil)
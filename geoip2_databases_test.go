@@ -0,0 +1,61 @@
+package geoip2
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestDatabasesReusedAcrossReloads(t *testing.T) {
+	newState := func(editionIDs ...string) *GeoIP2State {
+		state := &GeoIP2State{
+			DatabaseDirectory: "replacer/test-data/test-data",
+			EditionIDs:        editionIDs,
+		}
+		if err := state.Provision(caddy.Context{}); err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+
+	old := newState("GeoIP2-Country-Test")
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	old.dbs.wg.Wait()
+	if !old.hasDBReaders() {
+		t.Fatal("no database readers loaded")
+	}
+
+	// A reload with the same configuration takes the databases over,
+	// as the new configuration is started before the old one is cleaned up.
+	reloaded := newState("GeoIP2-Country-Test")
+	if reloaded.dbs != old.dbs {
+		t.Fatal("unchanged configuration did not reuse the databases")
+	}
+	if err := reloaded.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.hasDBReaders() {
+		t.Fatal("databases closed while still in use")
+	}
+
+	changed := newState("GeoIP2-Country-Test", "GeoLite2-ASN-Test")
+	if changed.dbs == reloaded.dbs {
+		t.Error("changed configuration reused the databases")
+	}
+	for _, state := range []*GeoIP2State{reloaded, changed} {
+		if err := state.Cleanup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reloaded.hasDBReaders() {
+		t.Error("databases still open after the last cleanup")
+	}
+}
@@ -0,0 +1,270 @@
+package geoip2
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// DatabaseConfig configures a database of the geoip2 app.
+type DatabaseConfig struct {
+	// Name identifies the database, e.g. in logs and in the update state.
+	// Defaults to the edition ID.
+	Name string `json:"name,omitempty"`
+	// Path is the path of the database file. Relative paths are relative
+	// to the DatabaseDirectory of the app. Defaults to "<edition_id>.mmdb".
+	Path string `json:"path,omitempty"`
+	// EditionID is the MaxMind edition the database is updated from.
+	// Databases without an edition are loaded, but not updated.
+	EditionID string `json:"edition_id,omitempty"`
+	// UpdateFrequency is the interval at which the database is updated.
+	// Defaults to the UpdateFrequency of the app.
+	UpdateFrequency caddy.Duration `json:"update_frequency,omitempty"`
+	// UpdateSchedule is a cron expression of the update times, which
+	// replaces UpdateFrequency. Databases without either default to the
+	// UpdateSchedule or UpdateFrequency of the app.
+	UpdateSchedule string `json:"update_schedule,omitempty"`
+	// Required databases must be loaded for the app to be ready,
+	// see WaitForDatabases and the not_ready policy of geoip2_vars.
+	Required bool `json:"required,omitempty"`
+	// Priority orders the lookups. If several databases provide the same
+	// variable, the database with the highest priority sets it. Databases
+	// with the same priority are looked up in the configured order, so
+	// the last of them wins.
+	Priority int `json:"priority,omitempty"`
+	// Canary configures the checks a downloaded database has to pass
+	// before it replaces the database file.
+	Canary *CanaryConfig `json:"canary,omitempty"`
+	// Verify configures the digests or signature a downloaded database
+	// has to match before it replaces the database file.
+	Verify *VerifyConfig `json:"verify,omitempty"`
+	// KeepVersions is the number of downloaded versions kept next to
+	// the database file, which it can be rolled back to through the
+	// admin API. Defaults to the KeepVersions of the app.
+	KeepVersions int `json:"keep_versions,omitempty"`
+	// MaxAge is the age of the loaded database, by its build epoch,
+	// after which it is stale, see the on_stale policy of geoip2_vars.
+	// Defaults to the MaxAge of the app.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+
+	// SourceRaw is the module the database is downloaded from, in the
+	// geoip2.sources namespace. Databases with an edition ID default
+	// to MaxMind, other databases without a source are not updated.
+	SourceRaw json.RawMessage `json:"source,omitempty" caddy:"namespace=geoip2.sources inline_key=source"`
+
+	source Source
+}
+
+// databaseConfigs returns the configured databases in lookup order, with
+// defaults applied. The flat EditionIDs are shorthand for required
+// databases named after their edition and stored in DatabaseDirectory.
+func (g *GeoIP2State) databaseConfigs() []*DatabaseConfig {
+	var configs []*DatabaseConfig
+	for _, editionID := range g.EditionIDs {
+		configs = append(configs, &DatabaseConfig{Name: editionID, EditionID: editionID, Required: true})
+	}
+	for _, db := range g.Databases {
+		db := *db
+		configs = append(configs, &db)
+	}
+
+	for _, db := range configs {
+		if db.Name == "" {
+			db.Name = db.EditionID
+		}
+		if db.Path == "" && db.EditionID != "" {
+			db.Path = db.EditionID + ".mmdb"
+		}
+		if db.Path != "" && !filepath.IsAbs(db.Path) {
+			db.Path = filepath.Join(g.DatabaseDirectory, db.Path)
+		}
+		if db.UpdateFrequency == 0 && db.UpdateSchedule == "" {
+			db.UpdateSchedule = g.UpdateSchedule
+			db.UpdateFrequency = caddy.Duration(time.Second * time.Duration(g.UpdateFrequency))
+		}
+		if db.KeepVersions == 0 {
+			db.KeepVersions = g.KeepVersions
+		}
+		if db.MaxAge == 0 {
+			db.MaxAge = g.MaxAge
+		}
+	}
+	slices.SortStableFunc(configs, func(a, b *DatabaseConfig) int {
+		return cmp.Compare(a.Priority, b.Priority)
+	})
+	return configs
+}
+
+// loadSources loads the source modules of the databases configured in
+// g into copies of them, so that g keeps its JSON encoding.
+func (g *GeoIP2State) loadSources(ctx caddy.Context) error {
+	databases := make([]*DatabaseConfig, len(g.Databases))
+	for i, db := range g.Databases {
+		db := *db
+		databases[i] = &db
+		if db.SourceRaw == nil {
+			continue
+		}
+		mod, err := ctx.LoadModule(&db, "SourceRaw")
+		if err != nil {
+			return fmt.Errorf("database %q: loading source: %w", db.Name, err)
+		}
+		db.source = mod.(Source)
+		if src, ok := db.source.(*MaxMindSource); ok {
+			src.inherit(g)
+		}
+	}
+	g.Databases = databases
+	return nil
+}
+
+// validateDatabases checks the configured databases.
+func validateDatabases(configs []*DatabaseConfig) error {
+	if len(configs) == 0 {
+		return errors.New("no databases configured")
+	}
+	names := make(map[string]bool)
+	for _, db := range configs {
+		if db.Name == "" {
+			return errors.New("database without name or edition ID")
+		}
+		if names[db.Name] {
+			return fmt.Errorf("database %q configured more than once", db.Name)
+		}
+		names[db.Name] = true
+		if db.Path == "" {
+			return fmt.Errorf("database %q: missing path", db.Name)
+		}
+		if db.UpdateFrequency != 0 && db.UpdateSchedule != "" {
+			return fmt.Errorf("database %q: update_frequency and update_schedule cannot be combined", db.Name)
+		}
+		if db.Canary != nil {
+			for _, l := range db.Canary.Lookups {
+				if net.ParseIP(l.IP) == nil {
+					return fmt.Errorf("database %q: invalid canary IP address %q", db.Name, l.IP)
+				}
+			}
+		}
+		if db.Verify != nil {
+			if err := db.Verify.validate(); err != nil {
+				return fmt.Errorf("database %q: %w", db.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfile parses a database block.
+//
+//	database <name> {
+//	    path             <file>
+//	    edition_id       <edition>
+//	    update_frequency <duration>
+//	    update_schedule  <cron expression>
+//	    required
+//	    priority         <number>
+//	    keep_versions    <count>
+//	    max_age          <duration>
+//	    source           <module> ...
+//	    canary {
+//	        ...
+//	    }
+//	    verify {
+//	        ...
+//	    }
+//	}
+func (db *DatabaseConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		switch key {
+		case "required":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			db.Required = true
+			continue
+		case "canary":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			db.Canary = new(CanaryConfig)
+			if err := db.Canary.unmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			continue
+		case "verify":
+			db.Verify = new(VerifyConfig)
+			if err := db.Verify.unmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			continue
+		case "source":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "geoip2.sources."+name)
+			if err != nil {
+				return err
+			}
+			db.SourceRaw = caddyconfig.JSONModuleObject(unm, "source", name, nil)
+			continue
+		case "update_schedule":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			db.UpdateSchedule = strings.Join(args, " ")
+			continue
+		}
+
+		var value string
+		if !d.Args(&value) || d.NextArg() {
+			return d.ArgErr()
+		}
+		switch key {
+		case "path":
+			db.Path = value
+		case "edition_id":
+			db.EditionID = value
+		case "update_frequency":
+			frequency, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("update_frequency is not a duration: %v", err)
+			}
+			db.UpdateFrequency = caddy.Duration(frequency)
+		case "priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("priority is not an integer: %v", err)
+			}
+			db.Priority = priority
+		case "keep_versions":
+			keep, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("keep_versions is not an integer: %v", err)
+			}
+			db.KeepVersions = keep
+		case "max_age":
+			maxAge, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("max_age is not a duration: %v", err)
+			}
+			db.MaxAge = caddy.Duration(maxAge)
+		default:
+			return d.Errf("unrecognized database subdirective %q", key)
+		}
+	}
+	return nil
+}
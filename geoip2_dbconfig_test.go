@@ -0,0 +1,93 @@
+package geoip2
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestDatabaseCaddyfile(t *testing.T) {
+	g := &GeoIP2State{}
+	d := caddyfile.NewTestDispenser(`
+	geoip2 {
+		databaseDirectory "/var/lib/geoip"
+		editionID         "GeoLite2-ASN"
+		keep_versions     2
+		database city {
+			path             dbip-city-lite-2025-06.mmdb
+			update_frequency 12h
+			required
+			priority         10
+		}
+		database country {
+			path       /opt/geoip/country.mmdb
+			edition_id    GeoLite2-Country
+			keep_versions 5
+		}
+	}`)
+	if err := g.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := g.databaseConfigs()
+	if len(configs) != 3 {
+		t.Fatalf("got %d databases, want 3", len(configs))
+	}
+	// The city database has the highest priority, so it is looked up last.
+	asn, country, city := configs[0], configs[1], configs[2]
+	if asn.Name != "GeoLite2-ASN" || !asn.Required || asn.Path != filepath.Join("/var/lib/geoip", "GeoLite2-ASN.mmdb") ||
+		asn.KeepVersions != 2 {
+		t.Errorf("unexpected shorthand database: %+v", asn)
+	}
+	if country.Name != "country" || country.EditionID != "GeoLite2-Country" || country.Required || country.Path != "/opt/geoip/country.mmdb" ||
+		country.KeepVersions != 5 {
+		t.Errorf("unexpected country database: %+v", country)
+	}
+	if city.Name != "city" || city.EditionID != "" || !city.Required || city.Priority != 10 ||
+		city.Path != filepath.Join("/var/lib/geoip", "dbip-city-lite-2025-06.mmdb") ||
+		time.Duration(city.UpdateFrequency) != 12*time.Hour {
+		t.Errorf("unexpected city database: %+v", city)
+	}
+
+	duplicate := &GeoIP2State{
+		DatabaseDirectory: "/var/lib/geoip",
+		EditionIDs:        []string{"GeoLite2-City"},
+		Databases:         []*DatabaseConfig{{EditionID: "GeoLite2-City"}},
+	}
+	if err := duplicate.Validate(); err == nil {
+		t.Error("expected a database configured twice to be invalid")
+	}
+}
+
+func TestOptionalDatabases(t *testing.T) {
+	state := &GeoIP2State{
+		DatabaseDirectory: "replacer/test-data/test-data",
+		Databases: []*DatabaseConfig{
+			{Name: "asn", Path: "GeoLite2-ASN-Test.mmdb", Required: true, Priority: 1},
+			{Name: "country", Path: "GeoIP2-Country-Test.mmdb", Required: true},
+			{Name: "missing", Path: "Missing.mmdb"},
+		},
+	}
+	if err := state.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { state.Cleanup() })
+	state.dbs.loadGeoIPReaders()
+
+	if !state.isReady() {
+		t.Error("state not ready with all required databases loaded")
+	}
+	var names []string
+	for _, r := range state.dbs.readers.Load().readers {
+		names = append(names, r.name)
+	}
+	if len(names) != 2 || names[0] != "country" || names[1] != "asn" {
+		t.Errorf("readers %v, want [country asn] in lookup order", names)
+	}
+}
@@ -0,0 +1,83 @@
+package geoip2
+
+import (
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+// Events emitted through the events app. Their data includes the
+// instance, database, edition and path of the database.
+const (
+	// eventUpdateStarted is emitted when a database is checked for updates.
+	eventUpdateStarted = "geoip2.update_started"
+	// eventDatabaseUpdated is emitted when a database file was replaced,
+	// with its build epoch, size and MD5 checksum.
+	eventDatabaseUpdated = "geoip2.database_updated"
+	// eventUpdateFailed is emitted when an update check failed,
+	// with the error and the number of consecutive failures.
+	eventUpdateFailed = "geoip2.update_failed"
+	// eventDatabaseLoaded is emitted when a database file was
+	// loaded, with its build epoch and database type.
+	eventDatabaseLoaded = "geoip2.database_loaded"
+	// eventDatabaseStale is emitted when a loaded database missed a
+	// scheduled update, with the time of its last successful check,
+	// or exceeded its max age, with its build epoch and age.
+	eventDatabaseStale = "geoip2.database_stale"
+)
+
+// These are the reasons of eventDatabaseStale.
+const (
+	staleMissedUpdate = "missed_update"
+	staleMaxAge       = "max_age"
+)
+
+// eventEmitter emits events through the events app of a configuration.
+type eventEmitter struct {
+	app *caddyevents.App
+	ctx caddy.Context
+}
+
+// newEventEmitter returns an emitter through the events app of ctx,
+// or nil if the configuration has none.
+func newEventEmitter(ctx caddy.Context) *eventEmitter {
+	app, err := ctx.AppIfConfigured("events")
+	if err != nil {
+		return nil
+	}
+	events, ok := app.(*caddyevents.App)
+	if !ok {
+		return nil
+	}
+	return &eventEmitter{app: events, ctx: ctx}
+}
+
+// emit emits the event name about db with data, which may be nil.
+// Events are dropped if no configuration has an events app.
+func (d *databases) emit(name string, db *DatabaseConfig, data map[string]any) {
+	e := d.events.Load()
+	if e == nil {
+		return
+	}
+	if data == nil {
+		data = make(map[string]any)
+	}
+	data["instance"] = d.cfg.name
+	data["database"] = db.Name
+	data["edition"] = db.EditionID
+	data["path"] = db.Path
+	e.app.Emit(e.ctx, name, data)
+}
+
+// emitUpdated emits eventDatabaseUpdated for the current file of db.
+func (d *databases) emitUpdated(db *DatabaseConfig, md5 string) {
+	data := map[string]any{"md5": md5}
+	if info, err := os.Stat(db.Path); err == nil {
+		data["size"] = info.Size()
+	}
+	if epoch, err := buildEpoch(db.Path); err == nil {
+		data["build_epoch"] = epoch
+	}
+	d.emit(eventDatabaseUpdated, db, data)
+}
@@ -0,0 +1,111 @@
+package geoip2
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+// recordingHandler records the events it handles.
+type recordingHandler struct {
+	mu     sync.Mutex
+	events []caddy.Event
+}
+
+func (h *recordingHandler) Handle(_ context.Context, e caddy.Event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, e)
+	return nil
+}
+
+// take returns and forgets the recorded events.
+func (h *recordingHandler) take() []caddy.Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := h.events
+	h.events = nil
+	return events
+}
+
+func newRecordingEmitter(t *testing.T) (*eventEmitter, *recordingHandler) {
+	t.Helper()
+	ctx := caddy.Context{Context: context.Background()}
+	app := new(caddyevents.App)
+	if err := app.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h := new(recordingHandler)
+	if err := app.On("", h); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return &eventEmitter{app: app, ctx: ctx}, h
+}
+
+func eventNames(events []caddy.Event) []string {
+	var names []string
+	for _, e := range events {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestDatabaseEvents(t *testing.T) {
+	dir := t.TempDir()
+	upstream := filepath.Join(t.TempDir(), "country.mmdb.gz")
+	if err := os.WriteFile(upstream, gzipData(t, readTestDatabase(t, "GeoIP2-Country-Test")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	d := newDatabases(GeoIP2State{
+		DatabaseDirectory: dir,
+		LockFile:          filepath.Join(dir, "geoip2.lock"),
+		Databases:         []*DatabaseConfig{{Name: "country", EditionID: "GeoIP2-Country", Path: "country.mmdb"}},
+	})
+	emitter, h := newRecordingEmitter(t)
+	d.events.Store(emitter)
+	t.Cleanup(func() { d.Destruct() })
+
+	d.configs[0].source = &URLSource{URL: "file://" + upstream}
+	d.wg.Add(1)
+	d.runGeoIPUpdate()
+	events := h.take()
+	want := []string{eventUpdateStarted, eventDatabaseUpdated, eventDatabaseLoaded}
+	if got := eventNames(events); !slices.Equal(got, want) {
+		t.Fatalf("events %v, want %v", got, want)
+	}
+	updated := events[1].Data
+	info, err := os.Stat(filepath.Join(dir, "country.mmdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated["database"] != "country" || updated["edition"] != "GeoIP2-Country" || updated["instance"] != "" ||
+		updated["size"] != info.Size() || updated["build_epoch"] == nil || updated["md5"] == "" {
+		t.Errorf("unexpected database_updated data: %v", updated)
+	}
+	if loaded := events[2].Data; loaded["database_type"] != "GeoIP2-Country" || loaded["build_epoch"] == nil {
+		t.Errorf("unexpected database_loaded data: %v", loaded)
+	}
+
+	// A loaded database whose source fails missed its update and is stale.
+	os.Remove(filepath.Join(dir, updateStateFile))
+	d.configs[0].source = &URLSource{URL: "file://" + filepath.Join(dir, "missing.mmdb")}
+	d.wg.Add(1)
+	d.runGeoIPUpdate()
+	want = []string{eventUpdateStarted, eventUpdateFailed, eventDatabaseStale}
+	events = h.take()
+	if got := eventNames(events); !slices.Equal(got, want) {
+		t.Fatalf("events %v, want %v", got, want)
+	}
+	if failed := events[1].Data; failed["error"] == "" || failed["failures"] != 1 {
+		t.Errorf("unexpected update_failed data: %v", failed)
+	}
+}
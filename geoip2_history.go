@@ -0,0 +1,265 @@
+package geoip2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/zhangjiayin/caddy-geoip2/replacer"
+	"go.uber.org/zap"
+)
+
+// pinnedSuffix is appended to the path of a database to store
+// the build epoch of the version it is pinned to.
+const pinnedSuffix = ".pinned"
+
+// versionsDir returns the directory keeping the versions of db.
+func versionsDir(db *DatabaseConfig) string {
+	return strings.TrimSuffix(db.Path, filepath.Ext(db.Path)) + "-versions"
+}
+
+// versionPath returns the path of the version of db built at epoch.
+func versionPath(db *DatabaseConfig, epoch uint) string {
+	return filepath.Join(versionsDir(db), strconv.FormatUint(uint64(epoch), 10)+".mmdb")
+}
+
+// buildEpoch returns the build epoch of the database file at path.
+func buildEpoch(path string) (uint, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return r.Metadata.BuildEpoch, nil
+}
+
+// versions returns the build epochs of the kept versions of db in ascending order.
+func versions(db *DatabaseConfig) ([]uint, error) {
+	entries, err := os.ReadDir(versionsDir(db))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var epochs []uint
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".mmdb")
+		if !ok {
+			continue
+		}
+		if epoch, err := strconv.ParseUint(name, 10, 0); err == nil {
+			epochs = append(epochs, uint(epoch))
+		}
+	}
+	slices.Sort(epochs)
+	return epochs, nil
+}
+
+// keepVersion adds the database file at path to the versions of db.
+func keepVersion(db *DatabaseConfig, path string) error {
+	epoch, err := buildEpoch(path)
+	if err != nil {
+		return err
+	}
+	dst := versionPath(db, epoch)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(versionsDir(db), 0o700); err != nil {
+		return err
+	}
+	return linkFile(path, dst)
+}
+
+// pruneVersions removes the oldest versions of db beyond
+// db.KeepVersions. The version db is pinned to is kept.
+func pruneVersions(db *DatabaseConfig) error {
+	epochs, err := versions(db)
+	if err != nil {
+		return err
+	}
+	pinned, err := pinnedVersion(db)
+	if err != nil {
+		return err
+	}
+	excess := len(epochs) - db.KeepVersions
+	var errs []error
+	for _, epoch := range epochs {
+		if excess <= 0 {
+			break
+		}
+		if epoch == pinned {
+			continue
+		}
+		errs = append(errs, os.Remove(versionPath(db, epoch)))
+		excess--
+	}
+	return errors.Join(errs...)
+}
+
+// pinnedVersion returns the build epoch of the version
+// db is pinned to, or 0 if it is not pinned.
+func pinnedVersion(db *DatabaseConfig) (uint, error) {
+	data, err := os.ReadFile(db.Path + pinnedSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	epoch, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("decoding %s: %w", db.Path+pinnedSuffix, err)
+	}
+	return uint(epoch), nil
+}
+
+// writePin pins db to the version built at epoch.
+func writePin(db *DatabaseConfig, epoch uint) error {
+	return os.WriteFile(db.Path+pinnedSuffix, []byte(strconv.FormatUint(uint64(epoch), 10)), 0o600)
+}
+
+// linkFile atomically replaces dst with the file at src,
+// as a hard link if possible and as a copy otherwise.
+func linkFile(src, dst string) error {
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		if err := copyFile(src, tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, dst)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// rollback replaces the database file of db with its version built
+// at epoch, or with the newest version older than the current one
+// if epoch is 0, and pins db to it. It returns the installed epoch.
+func (d *databases) rollback(db *DatabaseConfig, epoch uint) (uint, error) {
+	d.filesMu.Lock()
+	defer d.filesMu.Unlock()
+
+	if db.KeepVersions <= 0 {
+		return 0, fmt.Errorf("database %q keeps no versions", db.Name)
+	}
+	epochs, err := versions(db)
+	if err != nil {
+		return 0, err
+	}
+	if epoch == 0 {
+		current, err := buildEpoch(db.Path)
+		if err != nil {
+			return 0, err
+		}
+		for _, e := range epochs {
+			if e < current {
+				epoch = e
+			}
+		}
+		if epoch == 0 {
+			return 0, fmt.Errorf("database %q keeps no version older than %d", db.Name, current)
+		}
+	} else if !slices.Contains(epochs, epoch) {
+		return 0, fmt.Errorf("database %q keeps no version %d", db.Name, epoch)
+	}
+
+	if err := d.installVersion(db, epoch); err != nil {
+		return 0, err
+	}
+	return epoch, writePin(db, epoch)
+}
+
+// pin pins db to the version of its current database file,
+// so that it is not updated until it is unpinned.
+func (d *databases) pin(db *DatabaseConfig) (uint, error) {
+	d.filesMu.Lock()
+	defer d.filesMu.Unlock()
+
+	epoch, err := buildEpoch(db.Path)
+	if err != nil {
+		return 0, err
+	}
+	if db.KeepVersions > 0 {
+		if err := keepVersion(db, db.Path); err != nil {
+			return 0, err
+		}
+	}
+	return epoch, writePin(db, epoch)
+}
+
+// unpin resumes the updates of db. The newest kept version
+// is installed if it is newer than the current one.
+func (d *databases) unpin(db *DatabaseConfig) error {
+	d.filesMu.Lock()
+	defer d.filesMu.Unlock()
+
+	if err := os.Remove(db.Path + pinnedSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	epochs, err := versions(db)
+	if err != nil || len(epochs) == 0 {
+		return err
+	}
+	current, err := buildEpoch(db.Path)
+	if err != nil {
+		return err
+	}
+	if newest := epochs[len(epochs)-1]; newest > current {
+		return d.installVersion(db, newest)
+	}
+	return nil
+}
+
+// installVersion verifies the version of db built at epoch,
+// replaces the database file with it and loads it.
+func (d *databases) installVersion(db *DatabaseConfig, epoch uint) error {
+	path := versionPath(db, epoch)
+	r, err := replacer.NewVerified(path)
+	if err != nil {
+		return err
+	}
+	s := d.acquireReaders()
+	err = checkDatabaseType(r, s.reader(db.Name))
+	if s != nil {
+		s.release()
+	}
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := linkFile(path, db.Path); err != nil {
+		return err
+	}
+	caddy.Log().Named(moduleName).Info("installed database version",
+		zap.String("database", db.Name), zap.Uint("build_epoch", epoch))
+	d.loadGeoIPReaders()
+	return nil
+}
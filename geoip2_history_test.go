@@ -0,0 +1,105 @@
+package geoip2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// withBuildEpoch returns a copy of the database data built at epoch.
+func withBuildEpoch(t *testing.T, data []byte, epoch uint32) []byte {
+	t.Helper()
+	data = slices.Clone(data)
+	meta := bytes.LastIndex(data, []byte("\xab\xcd\xefMaxMind.com"))
+	if meta < 0 {
+		t.Fatal("database metadata not found")
+	}
+	key := bytes.Index(data[meta:], []byte("build_epoch"))
+	if key < 0 {
+		t.Fatal("build epoch not found in database metadata")
+	}
+	// The epoch is encoded as a four byte uint64.
+	value := data[meta+key+len("build_epoch"):]
+	if value[0] != 0x04 || value[1] != 0x02 {
+		t.Fatalf("unexpected build epoch encoding %x", value[:2])
+	}
+	binary.BigEndian.PutUint32(value[2:], epoch)
+	return data
+}
+
+func TestDatabaseVersions(t *testing.T) {
+	dir := t.TempDir()
+	db := &DatabaseConfig{
+		Name:         "GeoIP2-Country-Test",
+		Path:         filepath.Join(dir, "GeoIP2-Country-Test.mmdb"),
+		KeepVersions: 2,
+	}
+	d := newDatabases(GeoIP2State{DatabaseDirectory: dir, Databases: []*DatabaseConfig{db}})
+	db = d.configs[0]
+	t.Cleanup(func() { d.Destruct() })
+
+	data := readTestDatabase(t, "GeoIP2-Country-Test")
+	replaceFile(t, db.Path, withBuildEpoch(t, data, 1000))
+	d.loadGeoIPReaders()
+
+	download := func(epoch uint32) {
+		t.Helper()
+		candidate := db.Path + candidateSuffix
+		replaceFile(t, candidate, withBuildEpoch(t, data, epoch))
+		// Downloads are dated by their Last-Modified header.
+		modTime := time.Unix(int64(epoch), 0)
+		if err := os.Chtimes(candidate, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.promoteCandidate(context.Background(), db, candidate, nil); err != nil {
+			t.Fatal(err)
+		}
+		d.loadGeoIPReaders()
+	}
+	check := func(loaded uint, kept ...uint) {
+		t.Helper()
+		if got := d.readers.Load().reader(db.Name).Metadata().BuildEpoch; got != loaded {
+			t.Errorf("loaded build epoch %d, want %d", got, loaded)
+		}
+		if got, _ := versions(db); !slices.Equal(got, kept) {
+			t.Errorf("kept versions %v, want %v", got, kept)
+		}
+	}
+
+	download(2000)
+	check(2000, 1000, 2000)
+
+	// Rolling back installs and pins the previous version.
+	if epoch, err := d.rollback(db, 0); err != nil || epoch != 1000 {
+		t.Fatalf("rolled back to %d: %v", epoch, err)
+	}
+	check(1000, 1000, 2000)
+	if pinned, _ := pinnedVersion(db); pinned != 1000 {
+		t.Errorf("pinned to %d, want 1000", pinned)
+	}
+
+	// Pinned databases are not replaced, but their downloads are kept.
+	// The pinned version is retained beyond the limit.
+	download(3000)
+	check(1000, 1000, 3000)
+
+	// Unpinning installs the newest version.
+	if err := d.unpin(db); err != nil {
+		t.Fatal(err)
+	}
+	check(3000, 1000, 3000)
+
+	if _, err := d.rollback(db, 2000); err == nil {
+		t.Error("rolled back to a removed version")
+	}
+	download(4000)
+	check(4000, 3000, 4000)
+	if _, err := os.Stat(db.Path + pinnedSuffix); err == nil {
+		t.Error("pin not removed")
+	}
+}
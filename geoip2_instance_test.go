@@ -0,0 +1,93 @@
+package geoip2
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestInstanceCaddyfile(t *testing.T) {
+	t.Setenv("MAXMIND_LICENSE_KEY", "key")
+	g := &GeoIP2State{}
+	d := caddyfile.NewTestDispenser(`
+	geoip2 {
+		databaseDirectory "/var/lib/geoip"
+		instance enterprise {
+			accountId  1
+			licenseKey {env.MAXMIND_LICENSE_KEY}
+			editionID  "GeoIP2-Enterprise"
+			database asn {
+				edition_id GeoIP2-ISP
+			}
+		}
+		instance lite {
+			editionID "GeoLite2-Country"
+		}
+	}`)
+	if err := g.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(g.EditionIDs) != 0 || len(g.Instances) != 2 {
+		t.Fatalf("unexpected app: editions %v, %d instances", g.EditionIDs, len(g.Instances))
+	}
+	enterprise := g.Instances["enterprise"]
+	if enterprise.AccountID != 1 || enterprise.LicenseKey != "{env.MAXMIND_LICENSE_KEY}" || len(enterprise.Databases) != 1 ||
+		enterprise.DatabaseDirectory != filepath.Join("/var/lib/geoip", "enterprise") ||
+		enterprise.LockFile != filepath.Join("/var/lib/geoip", "enterprise", "geoip2.lock") {
+		t.Errorf("unexpected enterprise instance: %+v", enterprise)
+	}
+	lite := g.Instances["lite"]
+	if lite.AccountID != 0 || len(lite.EditionIDs) != 1 || lite.EditionIDs[0] != "GeoLite2-Country" {
+		t.Errorf("unexpected lite instance: %+v", lite)
+	}
+}
+
+func TestInstanceSelection(t *testing.T) {
+	g := &GeoIP2State{
+		Instances: map[string]*GeoIP2State{
+			"enterprise": {DatabaseDirectory: "replacer/test-data/test-data", EditionIDs: []string{"GeoIP2-Enterprise-Test"}},
+			"lite":       {DatabaseDirectory: "replacer/test-data/test-data", EditionIDs: []string{"GeoLite2-Country-Test"}},
+		},
+	}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Cleanup() })
+
+	if _, err := g.instance(""); err == nil {
+		t.Error("expected no default instance without top-level databases")
+	}
+	if _, err := g.instance("unknown"); err == nil {
+		t.Error("expected an unknown instance to be rejected")
+	}
+	for name, editionID := range map[string]string{"enterprise": "GeoIP2-Enterprise-Test", "lite": "GeoLite2-Country-Test"} {
+		inst, err := g.instance(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inst.dbs.loadGeoIPReaders()
+		readers := inst.dbs.readers.Load().readers
+		if len(readers) != 1 || readers[0].name != editionID {
+			t.Errorf("instance %s loaded %d readers, want %s", name, len(readers), editionID)
+		}
+	}
+	if g.Instances["enterprise"].dbs == g.Instances["lite"].dbs {
+		t.Error("instances share their databases")
+	}
+
+	nested := &GeoIP2State{Instances: map[string]*GeoIP2State{
+		"outer": {Instances: map[string]*GeoIP2State{"inner": {}}},
+	}}
+	if err := nested.Validate(); err == nil {
+		t.Error("expected nested instances to be invalid")
+	}
+}
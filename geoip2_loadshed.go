@@ -0,0 +1,232 @@
+package geoip2
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// GeoIP2LoadShed implements the http.handlers.geoip2_load_shed middleware.
+// It counts the requests in flight through the handler and, as that count
+// approaches MaxConcurrent, rejects requests of lower priority tiers first.
+// Tiers are selected by the variables of the geoip2_vars handler, which
+// must therefore be ordered before it.
+//
+// Rejected requests fail with 503 Service Unavailable and a Retry-After header.
+type GeoIP2LoadShed struct {
+	// MaxConcurrent is the number of requests in flight at which
+	// all requests are rejected.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// RetryAfter is sent to rejected clients. Defaults to 10s.
+	RetryAfter caddy.Duration `json:"retry_after,omitempty"`
+	// Tiers are evaluated in order, the first matching tier applies.
+	// Requests that match no tier are only rejected at MaxConcurrent.
+	Tiers []*LoadShedTier `json:"tiers,omitempty"`
+	// OnStale is the policy while geoip2_vars reports a stale
+	// database: "serve" selects tiers as usual (default) and
+	// "deny" rejects all requests.
+	OnStale string `json:"on_stale,omitempty"`
+
+	inFlight atomic.Int64
+}
+
+// LoadShedTier is a group of requests that is shed once the number
+// of requests in flight reaches ShedAt percent of MaxConcurrent.
+type LoadShedTier struct {
+	// Name of the tier, used in logs.
+	Name string `json:"name,omitempty"`
+	// ShedAt is the percentage of MaxConcurrent at which
+	// requests of this tier are rejected, from 1 to 100.
+	ShedAt int `json:"shed_at,omitempty"`
+	GeoCriteria
+
+	limit int64
+}
+
+func init() {
+	caddy.RegisterModule(&GeoIP2LoadShed{})
+	httpcaddyfile.RegisterHandlerDirective("geoip2_load_shed", parseLoadShedCaddyfile)
+}
+
+// CaddyModule implements caddy.Module.
+func (*GeoIP2LoadShed) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geoip2_load_shed",
+		New: func() caddy.Module { return new(GeoIP2LoadShed) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *GeoIP2LoadShed) Provision(_ caddy.Context) error {
+	caddy.Log().Named("http.handlers.geoip2_load_shed").Debug("provision")
+	if m.RetryAfter == 0 {
+		m.RetryAfter = caddy.Duration(10 * time.Second)
+	}
+	for _, tier := range m.Tiers {
+		if err := tier.provision(); err != nil {
+			return fmt.Errorf("tier %q: %w", tier.Name, err)
+		}
+		// Round up, so that a tier is never shed while idle.
+		tier.limit = (int64(m.MaxConcurrent)*int64(tier.ShedAt) + 99) / 100
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (m *GeoIP2LoadShed) Validate() error {
+	if m.MaxConcurrent <= 0 {
+		return fmt.Errorf("max_concurrent must be positive: %d", m.MaxConcurrent)
+	}
+	for _, tier := range m.Tiers {
+		if tier.ShedAt < 1 || tier.ShedAt > 100 {
+			return fmt.Errorf("tier %q: shed_at must be between 1 and 100: %d", tier.Name, tier.ShedAt)
+		}
+		if tier.empty() {
+			return fmt.Errorf("tier %q: no criteria configured", tier.Name)
+		}
+	}
+	return validateOnStale(m.OnStale)
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (m *GeoIP2LoadShed) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	if m.OnStale == onStaleDeny && requestStale(repl) {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds(time.Duration(m.RetryAfter))))
+		return caddyhttp.Error(http.StatusServiceUnavailable, errStale)
+	}
+
+	tier, limit := "", int64(m.MaxConcurrent)
+	for _, t := range m.Tiers {
+		if t.match(repl) {
+			tier, limit = t.Name, t.limit
+			break
+		}
+	}
+
+	inFlight := m.inFlight.Add(1)
+	defer m.inFlight.Add(-1)
+
+	if inFlight > limit {
+		caddy.Log().Named("http.handlers.geoip2_load_shed").Debug(
+			"shedding request",
+			zap.String("tier", tier),
+			zap.Int64("in_flight", inFlight),
+			zap.Int64("limit", limit),
+		)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds(time.Duration(m.RetryAfter))))
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("shedding load of tier %q", tier))
+	}
+	return next.ServeHTTP(w, r)
+}
+
+func parseLoadShedCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := &GeoIP2LoadShed{}
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	geoip2_load_shed [<max_concurrent>] {
+//	    max_concurrent <n>
+//	    retry_after    <duration>
+//	    on_stale       serve|deny
+//	    tier <name> {
+//	        shed_at      <percent>
+//	        countries    <codes...>
+//	        continents   <codes...>
+//	        subdivisions <codes...>
+//	        asns         <numbers...>
+//	        networks     <cidrs...>
+//	        anonymous    <flags...>
+//	    }
+//	}
+func (m *GeoIP2LoadShed) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			maxConcurrent, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("max_concurrent is not an integer: %v", err)
+			}
+			m.MaxConcurrent = maxConcurrent
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "max_concurrent":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxConcurrent, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("max_concurrent is not an integer: %v", err)
+				}
+				m.MaxConcurrent = maxConcurrent
+			case "retry_after":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				retryAfter, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid retry_after: %v", err)
+				}
+				m.RetryAfter = caddy.Duration(retryAfter)
+			case "on_stale":
+				if !d.Args(&m.OnStale) || d.NextArg() {
+					return d.ArgErr()
+				}
+			case "tier":
+				tier := &LoadShedTier{}
+				if !d.Args(&tier.Name) {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					if d.Val() == "shed_at" {
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						shedAt, err := strconv.Atoi(strings.TrimSuffix(d.Val(), "%"))
+						if err != nil {
+							return d.Errf("shed_at is not a percentage: %v", err)
+						}
+						tier.ShedAt = shedAt
+						continue
+					}
+					ok, err := tier.GeoCriteria.unmarshalCaddyfile(d)
+					if err != nil {
+						return err
+					}
+					if !ok {
+						return d.Errf("unrecognized subdirective %q", d.Val())
+					}
+				}
+				m.Tiers = append(m.Tiers, tier)
+			default:
+				return d.Errf("unrecognized subdirective %q", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards.
+var (
+	_ caddy.Module                = (*GeoIP2LoadShed)(nil)
+	_ caddy.Provisioner           = (*GeoIP2LoadShed)(nil)
+	_ caddy.Validator             = (*GeoIP2LoadShed)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GeoIP2LoadShed)(nil)
+	_ caddyfile.Unmarshaler       = (*GeoIP2LoadShed)(nil)
+)
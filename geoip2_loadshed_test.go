@@ -0,0 +1,101 @@
+package geoip2
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestLoadShedTiers(t *testing.T) {
+	m := &GeoIP2LoadShed{}
+	d := caddyfile.NewTestDispenser(`
+	geoip2_load_shed 10 {
+		retry_after 30s
+		tier hosting {
+			shed_at 50%
+			anonymous hosting_provider
+			asns AS16509
+		}
+		tier secondary {
+			shed_at 80
+			continents AS OC
+		}
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	hosting := map[string]any{"geoip2.is_hosting_provider": true}
+	amazon := map[string]any{"geoip2.autonomous_system_number": uint(16509)}
+	asia := map[string]any{"geoip2.continent_code": "AS"}
+	core := map[string]any{"geoip2.country_code": "GB", "geoip2.continent_code": "EU"}
+
+	for _, tc := range []struct {
+		inFlight int64
+		vars     map[string]any
+		shed     bool
+	}{
+		{0, hosting, false},
+		{4, hosting, false},
+		{5, hosting, true},
+		{5, amazon, true},
+		{5, asia, false},
+		{8, asia, true},
+		{8, core, false},
+		{9, core, false},
+		{10, core, true},
+	} {
+		m.inFlight.Store(tc.inFlight)
+		rec := httptest.NewRecorder()
+		err := m.ServeHTTP(rec, newGeoRequest(tc.vars), nextHandler)
+		if shed := err != nil; shed != tc.shed {
+			t.Errorf("in flight %d, vars %v: shed = %v, want %v", tc.inFlight, tc.vars, shed, tc.shed)
+			continue
+		}
+		if !tc.shed {
+			continue
+		}
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d, got %v", http.StatusServiceUnavailable, err)
+		}
+		if got := rec.Header().Get("Retry-After"); got != "30" {
+			t.Errorf("Retry-After = %q, want 30", got)
+		}
+	}
+	if got := m.inFlight.Load(); got != 10 {
+		t.Errorf("in-flight counter leaked: %d", got)
+	}
+}
+
+func TestLoadShedSmallLimit(t *testing.T) {
+	m := &GeoIP2LoadShed{
+		MaxConcurrent: 3,
+		Tiers: []*LoadShedTier{{
+			Name:        "asia",
+			ShedAt:      10,
+			GeoCriteria: GeoCriteria{Continents: []string{"AS"}},
+		}},
+	}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Tiers[0].limit; got != 1 {
+		t.Errorf("tier limit %d, want 1", got)
+	}
+	asia := map[string]any{"geoip2.continent_code": "AS"}
+	if err := m.ServeHTTP(httptest.NewRecorder(), newGeoRequest(asia), nextHandler); err != nil {
+		t.Errorf("idle handler shed the only request: %v", err)
+	}
+}
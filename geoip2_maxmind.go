@@ -0,0 +1,349 @@
+package geoip2
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate/database"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxMindTimeout    = 5 * time.Minute
+	defaultMaxMindAttempts   = 5
+	defaultMaxMindBackoff    = time.Second
+	defaultMaxMindMaxBackoff = time.Minute
+)
+
+func init() {
+	caddy.RegisterModule(MaxMindSource{})
+}
+
+// MaxMindSource downloads databases with the MaxMind update protocol. It
+// is the source of databases with an edition ID but without a source, and
+// its empty fields default to the account and update URL of the app.
+//
+// Downloads are conditional on the MD5 checksum and the entity tag of the
+// current database file. Failed requests are retried with exponential
+// backoff and jitter, unless MaxMind rejects them, e.g. for an invalid
+// license key or an unknown edition.
+type MaxMindSource struct {
+	// AccountID is the MaxMind account ID.
+	AccountID int `json:"account_id,omitempty"`
+	// LicenseKey is the MaxMind license key. It may be an {env.*}
+	// or {file.*} placeholder, which is resolved on provision.
+	LicenseKey string `json:"license_key,omitempty"`
+	// EditionID is the edition to download. Defaults to
+	// the edition ID of the database.
+	EditionID string `json:"edition_id,omitempty"`
+	// URL is the update server URL.
+	URL string `json:"url,omitempty"`
+	// Timeout limits each download request. Defaults to 5m.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// Attempts is the maximum number of requests per download. Defaults to 5.
+	Attempts int `json:"attempts,omitempty"`
+	// Backoff is the wait before the first retry, which doubles
+	// with every further retry. Defaults to 1s.
+	Backoff caddy.Duration `json:"backoff,omitempty"`
+	// MaxBackoff limits the wait between retries. Defaults to 1m.
+	MaxBackoff caddy.Duration `json:"max_backoff,omitempty"`
+}
+
+// CaddyModule implements caddy.Module.
+func (MaxMindSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "geoip2.sources.maxmind",
+		New: func() caddy.Module { return new(MaxMindSource) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (s *MaxMindSource) Provision(caddy.Context) error {
+	var err error
+	if s.LicenseKey, err = resolveSecret(s.LicenseKey); err != nil {
+		return fmt.Errorf("license_key: %w", err)
+	}
+	return nil
+}
+
+// inherit fills the empty fields from the app configuration cfg.
+func (s *MaxMindSource) inherit(cfg *GeoIP2State) {
+	if s.AccountID == 0 {
+		s.AccountID = cfg.AccountID
+	}
+	if s.LicenseKey == "" {
+		s.LicenseKey = cfg.LicenseKey
+	}
+	if s.URL == "" {
+		s.URL = cfg.UpdateURL
+	}
+}
+
+// Download implements Source.
+func (s *MaxMindSource) Download(ctx context.Context, req SourceRequest) (SourceResult, error) {
+	editionID := s.EditionID
+	if editionID == "" {
+		editionID = req.EditionID
+	}
+	if s.AccountID <= 0 || s.LicenseKey == "" {
+		return SourceResult{}, errors.New("missing MaxMind account ID or license key")
+	}
+	if editionID == "" {
+		return SourceResult{}, errors.New("missing MaxMind edition ID")
+	}
+
+	lock, err := database.CreateLockFile(req.LockFile, false)
+	if err != nil {
+		return SourceResult{}, err
+	}
+	defer lock.Unlock()
+
+	base := s.URL
+	if base == "" {
+		base = "https://updates.maxmind.com"
+	}
+	updateURL := fmt.Sprintf("%s/geoip/databases/%s/update?db_md5=%s",
+		strings.TrimSuffix(base, "/"), url.PathEscape(editionID), url.QueryEscape(req.CurrentMD5))
+
+	policy := retryPolicy{
+		attempts:   cmpOr(s.Attempts, defaultMaxMindAttempts),
+		backoff:    cmpOr(time.Duration(s.Backoff), defaultMaxMindBackoff),
+		maxBackoff: cmpOr(time.Duration(s.MaxBackoff), defaultMaxMindMaxBackoff),
+	}
+	var result SourceResult
+	err = policy.retry(ctx, func(attempt int) error {
+		if attempt > 1 {
+			caddy.Log().Named(moduleName).Info("retrying database download",
+				zap.String("database", req.Database), zap.Int("attempt", attempt))
+		}
+		result, err = s.download(ctx, req, updateURL)
+		return err
+	})
+	return result, err
+}
+
+// download performs a single update request.
+func (s *MaxMindSource) download(ctx context.Context, req SourceRequest, updateURL string) (SourceResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmpOr(time.Duration(s.Timeout), defaultMaxMindTimeout))
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, updateURL, nil)
+	if err != nil {
+		return SourceResult{}, permanent(err)
+	}
+	httpReq.SetBasicAuth(strconv.Itoa(s.AccountID), s.LicenseKey)
+	if req.ETag != "" {
+		httpReq.Header.Set("If-None-Match", req.ETag)
+	}
+	resp, err := req.Client.Do(httpReq)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return SourceResult{}, fmt.Errorf("requesting update: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return SourceResult{ETag: req.ETag}, nil
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return SourceResult{}, fmt.Errorf("requesting update: unexpected status %s", resp.Status)
+	default:
+		// MaxMind explains rejected requests in the body.
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return SourceResult{}, permanent(fmt.Errorf("requesting update: unexpected status %s: %s",
+			resp.Status, strings.TrimSpace(string(body))))
+	}
+
+	wantMD5 := resp.Header.Get("X-Database-MD5")
+	if wantMD5 == "" {
+		return SourceResult{}, errors.New("response without X-Database-MD5 header")
+	}
+	gotMD5, err := writeGzipped(resp.Body, req.Candidate)
+	if err != nil {
+		os.Remove(req.Candidate)
+		return SourceResult{}, err
+	}
+	if !strings.EqualFold(gotMD5, wantMD5) {
+		os.Remove(req.Candidate)
+		return SourceResult{}, fmt.Errorf("md5 of the downloaded database (%s) does not match the expected md5 (%s)", gotMD5, wantMD5)
+	}
+	if gotMD5 == req.CurrentMD5 {
+		os.Remove(req.Candidate)
+		return SourceResult{ETag: resp.Header.Get("ETag")}, nil
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		if err := os.Chtimes(req.Candidate, modTime, modTime); err != nil {
+			return SourceResult{}, err
+		}
+	}
+	return SourceResult{Downloaded: true, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// writeGzipped decompresses r to the file at path and
+// returns the hex encoded MD5 checksum of the decompressed data.
+func writeGzipped(r io.Reader, path string) (string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return "", fmt.Errorf("decompressing database: %w", err)
+	}
+	defer gz.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return "", permanent(err)
+	}
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), gz); err != nil {
+		f.Close()
+		return "", fmt.Errorf("downloading database: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// retryPolicy retries failed operations with exponential backoff and jitter.
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// retry calls fn until it succeeds, fails permanently, the attempts are
+// exhausted or ctx is done. fn is passed the number of the attempt,
+// starting at 1. The wait before each retry is drawn from the upper
+// half of the current backoff, which doubles after every retry.
+func (p retryPolicy) retry(ctx context.Context, fn func(attempt int) error) error {
+	backoff := p.backoff
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		var perm *permanentError
+		if err == nil || errors.As(err, &perm) || attempt >= p.attempts {
+			return err
+		}
+		wait := backoff/2 + rand.N(backoff/2+1)
+		backoff = min(2*backoff, p.maxBackoff)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		}
+	}
+}
+
+// permanentError is an error that is not resolved by retrying.
+type permanentError struct {
+	err error
+}
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+// cmpOr returns value, or def if value is not positive.
+func cmpOr[T int | time.Duration](value, def T) T {
+	if value > 0 {
+		return value
+	}
+	return def
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	source maxmind [<edition_id>] {
+//	    account_id  <id>
+//	    license_key <key>
+//	    url         <update url>
+//	    timeout     <duration>
+//	    attempts    <count>
+//	    backoff     <duration>
+//	    max_backoff <duration>
+//	}
+func (s *MaxMindSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume source name
+	d.Args(&s.EditionID)
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		var value string
+		if !d.Args(&value) || d.NextArg() {
+			return d.ArgErr()
+		}
+		switch key {
+		case "account_id":
+			accountID, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("account_id is not an integer: %v", err)
+			}
+			s.AccountID = accountID
+		case "license_key":
+			licenseKey, err := caddyfileSecret(d, key, value)
+			if err != nil {
+				return err
+			}
+			s.LicenseKey = licenseKey
+		case "url":
+			s.URL = value
+		case "attempts":
+			attempts, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("attempts is not an integer: %v", err)
+			}
+			s.Attempts = attempts
+		case "timeout", "backoff", "max_backoff":
+			dur, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("%s is not a duration: %v", key, err)
+			}
+			switch key {
+			case "timeout":
+				s.Timeout = caddy.Duration(dur)
+			case "backoff":
+				s.Backoff = caddy.Duration(dur)
+			case "max_backoff":
+				s.MaxBackoff = caddy.Duration(dur)
+			}
+		default:
+			return d.Errf("unrecognized maxmind source subdirective %q", key)
+		}
+	}
+	return nil
+}
+
+// Interface guards.
+var (
+	_ Source                = (*MaxMindSource)(nil)
+	_ caddy.Provisioner     = (*MaxMindSource)(nil)
+	_ caddyfile.Unmarshaler = (*MaxMindSource)(nil)
+)
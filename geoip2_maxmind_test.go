@@ -0,0 +1,166 @@
+package geoip2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// newMaxMindSource returns a source for srv which retries quickly.
+func newMaxMindSource(srv *httptest.Server) *MaxMindSource {
+	return &MaxMindSource{
+		AccountID:  1,
+		LicenseKey: "key",
+		EditionID:  "GeoIP2-Country-Test",
+		URL:        srv.URL,
+		Attempts:   3,
+		Backoff:    caddy.Duration(time.Millisecond),
+		MaxBackoff: caddy.Duration(5 * time.Millisecond),
+	}
+}
+
+func TestMaxMindSource(t *testing.T) {
+	data := readTestDatabase(t, "GeoIP2-Country-Test")
+	sum, err := fileMD5("replacer/test-data/test-data/GeoIP2-Country-Test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastModified := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	var requests, failures atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if user, pass, _ := r.BasicAuth(); user != "1" || pass != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Invalid license key"))
+			return
+		}
+		if r.URL.Path != "/geoip/databases/GeoIP2-Country-Test/update" {
+			http.NotFound(w, r)
+			return
+		}
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("X-Database-MD5", sum)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Write(gzipData(t, data))
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	src := newMaxMindSource(srv)
+
+	// Transient failures are retried.
+	failures.Store(2)
+	req := newSourceRequest(t, dir)
+	result, err := src.Download(context.Background(), req)
+	if err != nil || !result.Downloaded {
+		t.Fatalf("downloaded %v: %v", result.Downloaded, err)
+	}
+	if result.ETag != `"v1"` || requests.Load() != 3 {
+		t.Errorf("got etag %s after %d requests", result.ETag, requests.Load())
+	}
+	if info, err := os.Stat(req.Candidate); err != nil || !info.ModTime().Equal(lastModified) {
+		t.Errorf("candidate not dated by Last-Modified: %v", err)
+	}
+	promote(t, req)
+
+	// Downloads are conditional on the entity tag.
+	req = newSourceRequest(t, dir)
+	req.CurrentMD5 = "stale"
+	req.ETag = result.ETag
+	if result, err := src.Download(context.Background(), req); err != nil || result.Downloaded || result.ETag != `"v1"` {
+		t.Fatalf("downloaded %v with etag %s: %v", result.Downloaded, result.ETag, err)
+	}
+
+	// The retries are bounded.
+	requests.Store(0)
+	failures.Store(5)
+	if _, err := src.Download(context.Background(), req); err == nil || requests.Load() != 3 {
+		t.Errorf("got %d requests for a failing server: %v", requests.Load(), err)
+	}
+
+	// Rejected requests are not retried.
+	requests.Store(0)
+	failures.Store(0)
+	src.LicenseKey = "wrong"
+	if _, err := src.Download(context.Background(), req); err == nil || !strings.Contains(err.Error(), "Invalid license key") || requests.Load() != 1 {
+		t.Errorf("got %d requests with a wrong license key: %v", requests.Load(), err)
+	}
+}
+
+func TestMaxMindSourceMD5Mismatch(t *testing.T) {
+	data := readTestDatabase(t, "GeoIP2-Country-Test")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Database-MD5", "00000000000000000000000000000001")
+		w.Write(gzipData(t, data))
+	}))
+	t.Cleanup(srv.Close)
+
+	req := newSourceRequest(t, t.TempDir())
+	if _, err := newMaxMindSource(srv).Download(context.Background(), req); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("unexpected error for a corrupt download: %v", err)
+	}
+	if _, err := os.Stat(req.Candidate); err == nil {
+		t.Error("corrupt candidate left behind")
+	}
+}
+
+func TestMaxMindSourceCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+
+	src := newMaxMindSource(srv)
+	src.Attempts = 10
+	src.Backoff = caddy.Duration(time.Hour)
+	src.MaxBackoff = caddy.Duration(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := src.Download(ctx, newSourceRequest(t, t.TempDir()))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error for a cancelled download: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("cancelled download took %s", elapsed)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := retryPolicy{attempts: 4, backoff: time.Millisecond, maxBackoff: 2 * time.Millisecond}
+	var attempts int
+	err := p.retry(context.Background(), func(attempt int) error {
+		attempts = attempt
+		if attempt < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("succeeded after %d attempts: %v", attempts, err)
+	}
+
+	errRejected := errors.New("rejected")
+	err = p.retry(context.Background(), func(attempt int) error {
+		attempts = attempt
+		return permanent(errRejected)
+	})
+	if !errors.Is(err, errRejected) || attempts != 1 {
+		t.Errorf("permanent error retried %d times: %v", attempts, err)
+	}
+}
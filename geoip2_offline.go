@@ -0,0 +1,48 @@
+package geoip2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// checkOfflineFiles checks that the files of the configured databases
+// exist and are readable, since an offline configuration cannot
+// download them. The error lists every missing or unreadable file.
+func checkOfflineFiles(configs []*DatabaseConfig) error {
+	var problems []string
+	for _, db := range configs {
+		if err := checkReadable(db.Path); err != nil {
+			problems = append(problems, fmt.Sprintf("database %q: %v", db.Name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("offline: %d database file(s) missing or unreadable: %s",
+			len(problems), strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkReadable checks that path is a regular file that can be read.
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if _, err := f.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	return nil
+}
+
+// errOffline is returned by changes to the files of offline databases.
+var errOffline = errors.New("databases are offline and read-only")
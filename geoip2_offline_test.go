@@ -0,0 +1,109 @@
+package geoip2
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestOfflineReportsMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	replaceFile(t, filepath.Join(dir, "GeoIP2-Country-Test.mmdb"), readTestDatabase(t, "GeoIP2-Country-Test"))
+	if err := os.Mkdir(filepath.Join(dir, "GeoIP2-ISP-Test.mmdb"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &GeoIP2State{
+		DatabaseDirectory: dir,
+		EditionIDs:        []string{"GeoIP2-Country-Test", "GeoIP2-City-Test", "GeoIP2-ISP-Test"},
+		Offline:           true,
+	}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	err := g.Provision(caddy.Context{})
+	if err == nil {
+		g.Cleanup()
+		t.Fatal("missing database files accepted")
+	}
+	for _, want := range []string{`"GeoIP2-City-Test"`, `"GeoIP2-ISP-Test"`, "2 database file(s)"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), `"GeoIP2-Country-Test"`) {
+		t.Errorf("error %q mentions a readable file", err)
+	}
+
+	g.Cluster = true
+	if err := g.Validate(); err == nil {
+		t.Error("offline cluster accepted")
+	}
+}
+
+func TestOfflineWritesNothing(t *testing.T) {
+	var requests atomic.Int64
+	srv := newUpdateServer(t, &requests)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	replaceFile(t, path, readTestDatabase(t, "GeoIP2-Country-Test"))
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDatabases(GeoIP2State{
+		AccountID:         1,
+		LicenseKey:        "key",
+		DatabaseDirectory: dir,
+		LockFile:          filepath.Join(dir, "locks", "geoip2.lock"),
+		EditionIDs:        []string{"GeoIP2-Country-Test"},
+		UpdateURL:         srv.URL,
+		Offline:           true,
+	})
+	if err := d.start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.waitForDatabases(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	d.Destruct()
+
+	if n := requests.Load(); n != 0 {
+		t.Errorf("%d update requests while offline", n)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("files created while offline: %v", names)
+	}
+}
+
+func TestOfflineCaddyfile(t *testing.T) {
+	g := &GeoIP2State{}
+	d := caddyfile.NewTestDispenser(`
+	geoip2 {
+		offline true
+		instance lite {
+			editionID "GeoLite2-Country"
+		}
+	}`)
+	if err := g.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Offline || !g.Instances["lite"].Offline {
+		t.Errorf("offline not inherited: app %t, instance %t", g.Offline, g.Instances["lite"].Offline)
+	}
+}
@@ -0,0 +1,605 @@
+package geoip2
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// These are the possible values GeoIP2RateLimit.Key can have:
+// - "country" limits by the ISO country code.
+// - "asn" limits by the autonomous system number.
+// - "subdivision" limits by the ISO 3166-2 subdivision, e.g. "GB-ENG".
+// - "network" limits by the network prefix of the client address.
+const (
+	rateLimitKeyCountry     = "country"
+	rateLimitKeyASN         = "asn"
+	rateLimitKeySubdivision = "subdivision"
+	rateLimitKeyNetwork     = "network"
+)
+
+// rateLimitCounterRetention is how long the counters of
+// a key value are kept after it was last seen.
+const rateLimitCounterRetention = time.Hour
+
+// GeoIP2RateLimit implements the http.handlers.geoip2_rate_limit middleware.
+// It applies in-memory token bucket limits keyed by the geographic or
+// network origin of a request. It relies on the variables set by the
+// geoip2_vars handler and must therefore be ordered after it.
+//
+// Every distinct key value (e.g. every country) gets its own bucket.
+// Key values listed in a group use the group's budget, all other
+// values use the default budget. Requests for which no key value
+// can be determined are not limited.
+type GeoIP2RateLimit struct {
+	// Name identifies the limiter in the admin API.
+	// Defaults to the key.
+	Name string `json:"name,omitempty"`
+	// Key is the origin attribute requests are grouped by.
+	// Defaults to "country".
+	Key string `json:"key,omitempty"`
+	// IPv4Prefix and IPv6Prefix are the prefix lengths used
+	// for the "network" key. Default to 24 and 48.
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+	// RateLimitBudget is the default budget applied to
+	// key values that are not part of any group. A zero
+	// rate leaves those key values unlimited.
+	RateLimitBudget
+	// Groups assign separate budgets to specific key values.
+	Groups []*RateLimitGroup `json:"groups,omitempty"`
+	// OnStale is the policy while geoip2_vars reports a stale
+	// database: "serve" limits by the key as usual (default)
+	// and "deny" responds with 503 Service Unavailable.
+	OnStale string `json:"on_stale,omitempty"`
+
+	limiter *rateLimiter
+	done    chan struct{}
+}
+
+// RateLimitBudget describes a token bucket: Rate tokens
+// are refilled every Window, up to Burst tokens.
+type RateLimitBudget struct {
+	// Rate is the number of requests allowed per Window.
+	Rate int `json:"rate,omitempty"`
+	// Window is the period over which Rate applies.
+	// Defaults to one minute.
+	Window caddy.Duration `json:"window,omitempty"`
+	// Burst is the bucket capacity. Defaults to Rate.
+	Burst int `json:"burst,omitempty"`
+}
+
+// RateLimitGroup applies a budget to a set of key values.
+type RateLimitGroup struct {
+	// Name of the group, reported in the admin API.
+	Name string `json:"name,omitempty"`
+	// Match lists the key values of this group: country codes,
+	// autonomous system numbers, subdivisions or CIDR ranges.
+	Match []string `json:"match,omitempty"`
+	RateLimitBudget
+
+	networks []*net.IPNet
+}
+
+func init() {
+	caddy.RegisterModule(GeoIP2RateLimit{})
+	httpcaddyfile.RegisterHandlerDirective("geoip2_rate_limit", parseRateLimitCaddyfile)
+}
+
+// CaddyModule implements caddy.Module.
+func (GeoIP2RateLimit) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geoip2_rate_limit",
+		New: func() caddy.Module { return new(GeoIP2RateLimit) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *GeoIP2RateLimit) Provision(ctx caddy.Context) error {
+	caddy.Log().Named("http.handlers.geoip2_rate_limit").Debug("provision")
+	if m.Key == "" {
+		m.Key = rateLimitKeyCountry
+	}
+	if m.Name == "" {
+		m.Name = m.Key
+	}
+	if m.IPv4Prefix == 0 {
+		m.IPv4Prefix = 24
+	}
+	if m.IPv6Prefix == 0 {
+		m.IPv6Prefix = 48
+	}
+	m.RateLimitBudget.setDefaults()
+	// Provision runs before Validate, but the sweep
+	// below needs a positive window.
+	if err := m.RateLimitBudget.validate(); err != nil {
+		return err
+	}
+	for _, group := range m.Groups {
+		group.setDefaults()
+		if err := group.validate(); err != nil {
+			return fmt.Errorf("group %q: %w", group.Name, err)
+		}
+		if m.Key != rateLimitKeyNetwork {
+			continue
+		}
+		for _, cidr := range group.Match {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("group %q: %w", group.Name, err)
+			}
+			group.networks = append(group.networks, network)
+		}
+	}
+
+	m.limiter = &rateLimiter{
+		owner:    ctx.Context,
+		buckets:  make(map[string]*tokenBucket),
+		counters: make(map[string]*rateLimitCounters),
+	}
+	if err := registerRateLimiter(m.Name, m.limiter); err != nil {
+		return err
+	}
+
+	m.done = make(chan struct{})
+	go m.limiter.sweep(time.Duration(m.maxWindow()), m.done)
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (m *GeoIP2RateLimit) Validate() error {
+	switch m.Key {
+	case rateLimitKeyCountry, rateLimitKeyASN, rateLimitKeySubdivision, rateLimitKeyNetwork:
+	default:
+		return fmt.Errorf("unsupported rate limit key: %q", m.Key)
+	}
+	if m.IPv4Prefix < 0 || m.IPv4Prefix > 32 || m.IPv6Prefix < 0 || m.IPv6Prefix > 128 {
+		return fmt.Errorf("invalid network prefix lengths: /%d, /%d", m.IPv4Prefix, m.IPv6Prefix)
+	}
+	if err := m.RateLimitBudget.validate(); err != nil {
+		return err
+	}
+	for _, group := range m.Groups {
+		if len(group.Match) == 0 {
+			return fmt.Errorf("group %q: no key values to match", group.Name)
+		}
+		if err := group.validate(); err != nil {
+			return fmt.Errorf("group %q: %w", group.Name, err)
+		}
+	}
+	return validateOnStale(m.OnStale)
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (m *GeoIP2RateLimit) Cleanup() error {
+	if m.done != nil {
+		close(m.done)
+	}
+	unregisterRateLimiter(m.Name, m.limiter)
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (m *GeoIP2RateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	if m.OnStale == onStaleDeny && requestStale(repl) {
+		return caddyhttp.Error(http.StatusServiceUnavailable, errStale)
+	}
+
+	key := m.keyValue(repl)
+	if key == "" {
+		return next.ServeHTTP(w, r)
+	}
+	group, budget := m.budgetFor(key)
+	if budget.Rate <= 0 {
+		return next.ServeHTTP(w, r)
+	}
+
+	allowed, remaining, reset := m.limiter.take(group+"/"+key, budget, time.Now())
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(budget.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(reset)))
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds(reset)))
+		caddy.Log().Named("http.handlers.geoip2_rate_limit").Debug(
+			"rate limit exceeded",
+			zap.String("limiter", m.Name),
+			zap.String("group", group),
+			zap.String("key", key),
+		)
+		return caddyhttp.Error(http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded for %s %q", m.Key, key))
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// keyValue returns the value of the configured key for the current request.
+func (m *GeoIP2RateLimit) keyValue(repl *caddy.Replacer) string {
+	switch m.Key {
+	case rateLimitKeyCountry:
+		value, _ := repl.GetString("geoip2.country_code")
+		return value
+	case rateLimitKeyASN:
+		return asnValue(repl)
+	case rateLimitKeySubdivision:
+		country, _ := repl.GetString("geoip2.country_code")
+		subdivision, _ := repl.GetString("geoip2.subdivisions_1_iso_code")
+		if country == "" || subdivision == "" {
+			return ""
+		}
+		return country + "-" + subdivision
+	case rateLimitKeyNetwork:
+		address, _ := repl.GetString("geoip2.ip_address")
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return ""
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(m.IPv4Prefix, 32)), Mask: net.CIDRMask(m.IPv4Prefix, 32)}).String()
+		}
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(m.IPv6Prefix, 128)), Mask: net.CIDRMask(m.IPv6Prefix, 128)}).String()
+	}
+	return ""
+}
+
+// budgetFor returns the group name and budget that apply to key.
+func (m *GeoIP2RateLimit) budgetFor(key string) (string, RateLimitBudget) {
+	for _, group := range m.Groups {
+		if m.Key == rateLimitKeyNetwork {
+			_, network, err := net.ParseCIDR(key)
+			if err != nil {
+				continue
+			}
+			for _, n := range group.networks {
+				if n.Contains(network.IP) {
+					return group.Name, group.RateLimitBudget
+				}
+			}
+			continue
+		}
+		if containsFold(group.Match, key) {
+			return group.Name, group.RateLimitBudget
+		}
+	}
+	return "", m.RateLimitBudget
+}
+
+// maxWindow returns the longest window of all budgets.
+func (m *GeoIP2RateLimit) maxWindow() caddy.Duration {
+	window := m.Window
+	for _, group := range m.Groups {
+		window = max(window, group.Window)
+	}
+	return window
+}
+
+func (b *RateLimitBudget) setDefaults() {
+	if b.Window == 0 {
+		b.Window = caddy.Duration(time.Minute)
+	}
+	if b.Burst == 0 {
+		b.Burst = b.Rate
+	}
+}
+
+func (b *RateLimitBudget) validate() error {
+	if b.Rate < 0 || b.Burst < 0 {
+		return fmt.Errorf("rate and burst must not be negative")
+	}
+	if b.Window <= 0 {
+		return fmt.Errorf("window must be positive: %v", time.Duration(b.Window))
+	}
+	return nil
+}
+
+// seconds rounds d up to whole seconds.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimiter holds the token buckets of a single
+// geoip2_rate_limit handler.
+type rateLimiter struct {
+	// owner is the context of the configuration
+	// the limiter was provisioned in.
+	owner context.Context
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	// counters are kept apart from the buckets,
+	// which are removed once they have refilled.
+	counters map[string]*rateLimitCounters
+}
+
+// tokenBucket is the state of a single bucket.
+type tokenBucket struct {
+	tokens  float64
+	limit   int
+	refill  float64 // tokens per second
+	updated time.Time
+}
+
+// rateLimitCounters count the requests of a single key value.
+type rateLimitCounters struct {
+	Allowed  uint64    `json:"allowed"`
+	Denied   uint64    `json:"denied"`
+	LastSeen time.Time `json:"last_seen"`
+
+	limit int // burst of the last bucket
+}
+
+// rateLimitStatus describes a key value in the admin API.
+type rateLimitStatus struct {
+	Tokens float64 `json:"tokens"`
+	Limit  int     `json:"limit"`
+	rateLimitCounters
+}
+
+// take removes a token from the bucket for key. It returns whether
+// the request is allowed, the remaining tokens and the time until
+// the next token (if denied) or a full bucket (if allowed).
+func (l *rateLimiter) take(key string, budget RateLimitBudget, now time.Time) (bool, int, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{
+			tokens:  float64(budget.Burst),
+			limit:   budget.Burst,
+			refill:  float64(budget.Rate) / time.Duration(budget.Window).Seconds(),
+			updated: now,
+		}
+		l.buckets[key] = bucket
+	}
+	counters, ok := l.counters[key]
+	if !ok {
+		counters = new(rateLimitCounters)
+		l.counters[key] = counters
+	}
+	bucket.tokens = bucket.tokensAt(now)
+	bucket.updated = now
+	counters.LastSeen = now
+	counters.limit = bucket.limit
+
+	if bucket.tokens < 1 {
+		counters.Denied++
+		wait := time.Duration((1 - bucket.tokens) / bucket.refill * float64(time.Second))
+		return false, 0, wait
+	}
+	bucket.tokens--
+	counters.Allowed++
+	full := time.Duration((float64(bucket.limit) - bucket.tokens) / bucket.refill * float64(time.Second))
+	return true, int(bucket.tokens), full
+}
+
+// tokensAt returns the tokens of the bucket refilled until now.
+func (b *tokenBucket) tokensAt(now time.Time) float64 {
+	return math.Min(float64(b.limit), b.tokens+now.Sub(b.updated).Seconds()*b.refill)
+}
+
+// sweep periodically prunes the buckets and counters.
+func (l *rateLimiter) sweep(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.prune(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// prune removes the buckets that have refilled completely at now, as
+// they are equivalent to new buckets. Their counters are kept until
+// the key value has not been seen for rateLimitCounterRetention, so
+// that the memory used is bounded by the recently seen key values.
+func (l *rateLimiter) prune(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, bucket := range l.buckets {
+		if bucket.tokensAt(now) >= float64(bucket.limit) {
+			delete(l.buckets, key)
+		}
+	}
+	for key, counters := range l.counters {
+		if _, ok := l.buckets[key]; !ok && now.Sub(counters.LastSeen) > rateLimitCounterRetention {
+			delete(l.counters, key)
+		}
+	}
+}
+
+// snapshot returns the status of all key values at now. Key values
+// whose buckets were removed are reported with a full bucket.
+func (l *rateLimiter) snapshot(now time.Time) map[string]rateLimitStatus {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	status := make(map[string]rateLimitStatus, len(l.counters))
+	for key, counters := range l.counters {
+		s := rateLimitStatus{
+			Tokens:            float64(counters.limit),
+			Limit:             counters.limit,
+			rateLimitCounters: *counters,
+		}
+		if bucket, ok := l.buckets[key]; ok {
+			s.Tokens = bucket.tokensAt(now)
+		}
+		status[key] = s
+	}
+	return status
+}
+
+// rateLimiters holds the active limiters by name
+// so they can be inspected through the admin API.
+var (
+	rateLimitersMu sync.Mutex
+	rateLimiters   = make(map[string]*rateLimiter)
+)
+
+// registerRateLimiter registers l under name. A limiter of an older
+// configuration is replaced, while a second limiter of the same
+// configuration is rejected as their counters would be mixed up.
+func registerRateLimiter(name string, l *rateLimiter) error {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	if existing, ok := rateLimiters[name]; ok && existing.owner == l.owner {
+		return fmt.Errorf("duplicate rate limiter name %q; set a unique name", name)
+	}
+	rateLimiters[name] = l
+	return nil
+}
+
+func unregisterRateLimiter(name string, l *rateLimiter) {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	// A newer config may have registered its own limiter already.
+	if rateLimiters[name] == l {
+		delete(rateLimiters, name)
+	}
+}
+
+func parseRateLimitCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := &GeoIP2RateLimit{}
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	geoip2_rate_limit [<key>] {
+//	    name   <name>
+//	    key    country|asn|subdivision|network
+//	    prefix <ipv4_bits> [<ipv6_bits>]
+//	    rate   <requests> [<window>]
+//	    burst  <requests>
+//	    on_stale serve|deny
+//	    group  <name> {
+//	        match <values...>
+//	        rate  <requests> [<window>]
+//	        burst <requests>
+//	    }
+//	}
+func (m *GeoIP2RateLimit) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			m.Key = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "name":
+				if !d.Args(&m.Name) {
+					return d.ArgErr()
+				}
+			case "key":
+				if !d.Args(&m.Key) {
+					return d.ArgErr()
+				}
+			case "on_stale":
+				if !d.Args(&m.OnStale) || d.NextArg() {
+					return d.ArgErr()
+				}
+			case "prefix":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				v4, err := strconv.Atoi(args[0])
+				if err != nil {
+					return d.Errf("invalid IPv4 prefix length: %v", err)
+				}
+				m.IPv4Prefix = v4
+				if len(args) == 2 {
+					v6, err := strconv.Atoi(args[1])
+					if err != nil {
+						return d.Errf("invalid IPv6 prefix length: %v", err)
+					}
+					m.IPv6Prefix = v6
+				}
+			case "group":
+				group := &RateLimitGroup{}
+				if !d.Args(&group.Name) {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "match":
+						group.Match = append(group.Match, d.RemainingArgs()...)
+					default:
+						if err := group.RateLimitBudget.unmarshalCaddyfile(d); err != nil {
+							return err
+						}
+					}
+				}
+				m.Groups = append(m.Groups, group)
+			default:
+				if err := m.RateLimitBudget.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfile parses the rate and burst subdirectives
+// at the current position of d.
+func (b *RateLimitBudget) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	switch d.Val() {
+	case "rate":
+		args := d.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return d.ArgErr()
+		}
+		rate, err := strconv.Atoi(args[0])
+		if err != nil {
+			return d.Errf("rate is not an integer: %v", err)
+		}
+		b.Rate = rate
+		if len(args) == 2 {
+			window, err := caddy.ParseDuration(args[1])
+			if err != nil {
+				return d.Errf("invalid window: %v", err)
+			}
+			b.Window = caddy.Duration(window)
+		}
+	case "burst":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		burst, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("burst is not an integer: %v", err)
+		}
+		b.Burst = burst
+	default:
+		return d.Errf("unrecognized subdirective %q", d.Val())
+	}
+	return nil
+}
+
+// Interface guards.
+var (
+	_ caddy.Module                = (*GeoIP2RateLimit)(nil)
+	_ caddy.Provisioner           = (*GeoIP2RateLimit)(nil)
+	_ caddy.Validator             = (*GeoIP2RateLimit)(nil)
+	_ caddy.CleanerUpper          = (*GeoIP2RateLimit)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GeoIP2RateLimit)(nil)
+	_ caddyfile.Unmarshaler       = (*GeoIP2RateLimit)(nil)
+)
@@ -0,0 +1,224 @@
+package geoip2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// newGeoRequest returns a request whose replacer holds the given variables,
+// as if the geoip2_vars handler had already run.
+func newGeoRequest(vars map[string]any) *http.Request {
+	repl := caddy.NewEmptyReplacer()
+	for key, value := range vars {
+		repl.Set(key, value)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)
+	return req.WithContext(ctx)
+}
+
+var nextHandler = caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+})
+
+func TestRateLimitGroups(t *testing.T) {
+	m := &GeoIP2RateLimit{
+		Name:            "test-groups",
+		RateLimitBudget: RateLimitBudget{Rate: 3, Window: caddy.Duration(time.Hour)},
+		Groups: []*RateLimitGroup{{
+			Name:            "restricted",
+			Match:           []string{"cn", "RU"},
+			RateLimitBudget: RateLimitBudget{Rate: 1, Window: caddy.Duration(time.Hour)},
+		}},
+	}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	serve := func(country string) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		err := m.ServeHTTP(rec, newGeoRequest(map[string]any{"geoip2.country_code": country}), nextHandler)
+		return rec, err
+	}
+
+	for i := range 3 {
+		rec, err := serve("GB")
+		if err != nil {
+			t.Fatalf("GB request %d: %v", i, err)
+		}
+		if got := rec.Header().Get("RateLimit-Limit"); got != "3" {
+			t.Errorf("RateLimit-Limit = %q, want 3", got)
+		}
+	}
+	if _, err := serve("GB"); err == nil {
+		t.Error("expected 4th GB request to be limited")
+	}
+
+	if _, err := serve("CN"); err != nil {
+		t.Fatalf("first CN request: %v", err)
+	}
+	rec, err := serve("CN")
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %v", http.StatusTooManyRequests, err)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+	if got := rec.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("RateLimit-Remaining = %q, want 0", got)
+	}
+
+	// RU has a bucket of its own within the restricted group.
+	if _, err := serve("RU"); err != nil {
+		t.Fatalf("first RU request: %v", err)
+	}
+	// Requests without a country are not limited.
+	for range 5 {
+		if _, err := serve(""); err != nil {
+			t.Fatalf("request without country: %v", err)
+		}
+	}
+}
+
+func TestRateLimitNetwork(t *testing.T) {
+	m := &GeoIP2RateLimit{
+		Name:            "test-network",
+		Key:             rateLimitKeyNetwork,
+		RateLimitBudget: RateLimitBudget{Rate: 1, Window: caddy.Duration(time.Hour)},
+	}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	for _, tc := range []struct {
+		ip      string
+		limited bool
+	}{
+		{"81.2.69.1", false},
+		{"81.2.69.200", true},
+		{"81.2.70.1", false},
+		{"2001:218:1::1", false},
+		{"2001:218:1:2::1", true},
+	} {
+		err := m.ServeHTTP(httptest.NewRecorder(), newGeoRequest(map[string]any{"geoip2.ip_address": tc.ip}), nextHandler)
+		if limited := err != nil; limited != tc.limited {
+			t.Errorf("%s: limited = %v, want %v", tc.ip, limited, tc.limited)
+		}
+	}
+}
+
+func TestRateLimitAdmin(t *testing.T) {
+	m := &GeoIP2RateLimit{
+		Name:            "test-admin",
+		Key:             rateLimitKeyASN,
+		RateLimitBudget: RateLimitBudget{Rate: 10},
+	}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	req := newGeoRequest(map[string]any{"geoip2.autonomous_system_number": uint(1221)})
+	if err := m.ServeHTTP(httptest.NewRecorder(), req, nextHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := (&adminAPI{}).handleRateLimits(rec, httptest.NewRequest(http.MethodGet, "/geoip2/rate_limits", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]map[string]rateLimitStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	bucket, ok := result["test-admin"]["/1221"]
+	if !ok {
+		t.Fatalf("bucket for AS1221 not listed: %s", rec.Body.String())
+	}
+	if bucket.Allowed != 1 || bucket.Limit != 10 {
+		t.Errorf("unexpected bucket counters: %+v", bucket)
+	}
+}
+
+func TestRateLimitDuplicateNames(t *testing.T) {
+	first := &GeoIP2RateLimit{Name: "test-duplicate"}
+	if err := first.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	second := &GeoIP2RateLimit{Name: "test-duplicate"}
+	if err := second.Provision(caddy.Context{}); err == nil {
+		_ = second.Cleanup()
+		t.Error("duplicate name accepted within a configuration")
+	}
+
+	// A newer configuration replaces the limiter.
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	reloaded := &GeoIP2RateLimit{Name: "test-duplicate"}
+	if err := reloaded.Provision(ctx); err != nil {
+		_ = first.Cleanup()
+		t.Fatal(err)
+	}
+	_ = first.Cleanup()
+	rateLimitersMu.Lock()
+	registered := rateLimiters["test-duplicate"]
+	rateLimitersMu.Unlock()
+	if registered != reloaded.limiter {
+		t.Error("limiter of the newer configuration unregistered")
+	}
+	_ = reloaded.Cleanup()
+}
+
+func TestRateLimitPrune(t *testing.T) {
+	l := &rateLimiter{
+		buckets:  make(map[string]*tokenBucket),
+		counters: make(map[string]*rateLimitCounters),
+	}
+	budget := RateLimitBudget{Rate: 1, Window: caddy.Duration(time.Minute), Burst: 1}
+	now := time.Now()
+	l.take("/GB", budget, now)
+	l.take("/GB", budget, now)
+
+	// A refilled bucket is removed, its counters are kept.
+	l.prune(now.Add(2 * time.Minute))
+	if len(l.buckets) != 0 {
+		t.Fatal("refilled bucket not pruned")
+	}
+	status := l.snapshot(now.Add(2 * time.Minute))["/GB"]
+	if status.Allowed != 1 || status.Denied != 1 || status.Limit != 1 || status.Tokens != 1 {
+		t.Errorf("unexpected status after pruning the bucket: %+v", status)
+	}
+
+	// Counters of key values not seen within the retention are removed.
+	l.prune(now.Add(rateLimitCounterRetention + time.Minute))
+	if len(l.counters) != 0 {
+		t.Errorf("idle counters not pruned: %v", l.snapshot(now))
+	}
+}
+
+func TestRateLimitInvalidWindow(t *testing.T) {
+	m := &GeoIP2RateLimit{
+		Name:            "test-invalid-window",
+		RateLimitBudget: RateLimitBudget{Rate: 1, Window: caddy.Duration(-time.Second)},
+	}
+	if err := m.Provision(caddy.Context{}); err == nil {
+		_ = m.Cleanup()
+		t.Fatal("negative window accepted")
+	}
+}
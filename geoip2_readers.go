@@ -0,0 +1,162 @@
+package geoip2
+
+import (
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/zhangjiayin/caddy-geoip2/replacer"
+	"go.uber.org/zap"
+)
+
+// dbReader is a reference counted database reader. The reader is closed
+// once the last reference is released, so a reader can be shared by
+// several reader sets without being closed while one of them is in use.
+type dbReader struct {
+	replacer.Replacer
+	name string
+	// stamp identifies the version of the file the reader was opened from.
+	stamp fileStamp
+
+	refs atomic.Int64
+}
+
+// newDBReader wraps r, the reader of the named database,
+// with a single reference held by the caller.
+func newDBReader(name string, r replacer.Replacer) *dbReader {
+	reader := &dbReader{Replacer: r, name: name}
+	reader.refs.Store(1)
+	return reader
+}
+
+// retain adds a reference to the reader.
+func (r *dbReader) retain() {
+	r.refs.Add(1)
+}
+
+// release drops a reference and closes the reader with the last one.
+func (r *dbReader) release() {
+	if r.refs.Add(-1) != 0 {
+		return
+	}
+	if err := r.Close(); err != nil {
+		caddy.Log().Named(moduleName).
+			Error("closing geoip database reader", zap.String("database", r.name), zap.Error(err))
+		return
+	}
+	caddy.Log().Named(moduleName).
+		Debug("closed geoip database reader", zap.String("database", r.name))
+}
+
+// readerSet is an immutable snapshot of the database readers used
+// for lookups. The databases hold one reference to its current set and
+// every lookup holds another one while it runs. When a set is replaced,
+// their reference is dropped and the set releases its readers
+// as soon as the last lookup has finished.
+type readerSet struct {
+	readers []*dbReader
+
+	refs atomic.Int64
+}
+
+// newReaderSet returns a set holding a single reference owned by the
+// caller. The set takes over one reference of each of the readers.
+func newReaderSet(readers []*dbReader) *readerSet {
+	s := &readerSet{readers: readers}
+	s.refs.Store(1)
+	return s
+}
+
+// acquire adds a reference to the set unless it has already been
+// released completely, in which case it must not be used anymore.
+func (s *readerSet) acquire() bool {
+	for {
+		refs := s.refs.Load()
+		if refs <= 0 {
+			return false
+		}
+		if s.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference to the set. With the last reference,
+// the references to its readers are released as well.
+func (s *readerSet) release() {
+	if s.refs.Add(-1) != 0 {
+		return
+	}
+	for _, r := range s.readers {
+		r.release()
+	}
+}
+
+// acquireReaders returns the current reader set with a reference held
+// for the caller, who must release it. It returns nil if there is none.
+func (d *databases) acquireReaders() *readerSet {
+	for {
+		s := d.readers.Load()
+		if s == nil {
+			return nil
+		}
+		// The set can only fail to be acquired once it has been
+		// replaced, so the next load returns its successor.
+		if s.acquire() {
+			return s
+		}
+	}
+}
+
+// reader returns the reader of the named database, or nil if the set,
+// which may be nil itself, has none.
+func (s *readerSet) reader(name string) *dbReader {
+	if s == nil {
+		return nil
+	}
+	for _, r := range s.readers {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// swapReaders makes s the current reader set, which may be nil,
+// and retires the previous one. d.mu must be held.
+func (d *databases) swapReaders(s *readerSet) {
+	if old := d.readers.Swap(s); old != nil {
+		old.release()
+	}
+	d.markReady()
+}
+
+// replaceReader makes r the reader of its database, sharing the
+// readers of the other databases with the current reader set.
+func (d *databases) replaceReader(r *dbReader) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	current := map[string]*dbReader{r.name: r}
+	if s := d.readers.Load(); s != nil {
+		for _, reader := range s.readers {
+			if reader.name != r.name {
+				current[reader.name] = reader
+			}
+		}
+	}
+	// Keep the lookup order, since later databases
+	// override the variables set by earlier ones.
+	var readers []*dbReader
+	for _, db := range d.configs {
+		reader, ok := current[db.Name]
+		if !ok {
+			continue
+		}
+		if reader != r {
+			reader.retain()
+		}
+		readers = append(readers, reader)
+	}
+
+	d.swapReaders(newReaderSet(readers))
+}
@@ -0,0 +1,157 @@
+package geoip2
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// touchFile changes the modification time of path,
+// so that its database is reloaded.
+func touchFile(t *testing.T, path string) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderSetRetirement(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	replaceFile(t, path, readTestDatabase(t, "GeoIP2-Country-Test"))
+	d := newDatabases(GeoIP2State{DatabaseDirectory: dir, EditionIDs: []string{"GeoIP2-Country-Test"}})
+	d.loadGeoIPReaders()
+	t.Cleanup(func() { d.Destruct() })
+	ip := net.ParseIP("81.2.69.160")
+
+	old := d.acquireReaders()
+	if old == nil {
+		t.Fatal("no reader set loaded")
+	}
+
+	// Replacing the set must not close readers that are still in use.
+	touchFile(t, path)
+	d.loadGeoIPReaders()
+	if _, err := old.readers[0].Record(ip); err != nil {
+		t.Fatalf("retired reader closed while in use: %v", err)
+	}
+
+	// Releasing the last reference closes the readers.
+	old.release()
+	if old.acquire() {
+		t.Fatal("acquired a released reader set")
+	}
+	if _, err := old.readers[0].Record(ip); err == nil {
+		t.Fatal("retired reader still open after its last release")
+	}
+
+	if _, err := d.record(ip); err != nil {
+		t.Fatalf("looking up with the new reader set: %v", err)
+	}
+}
+
+// TestReaderSetStress runs lookups concurrently with reloads and cleanup.
+// Run it with the race detector to detect unsafe reader retirement.
+func TestReaderSetStress(t *testing.T) {
+	dir := t.TempDir()
+	for _, editionID := range []string{"GeoIP2-Country-Test", "GeoLite2-ASN-Test"} {
+		replaceFile(t, filepath.Join(dir, editionID+".mmdb"), readTestDatabase(t, editionID))
+	}
+	state := &GeoIP2State{
+		DatabaseDirectory: dir,
+		EditionIDs:        []string{"GeoIP2-Country-Test", "GeoLite2-ASN-Test"},
+	}
+	if err := state.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	state.dbs.loadGeoIPReaders()
+
+	ips := []net.IP{
+		net.ParseIP("81.2.69.160"),
+		net.ParseIP("1.128.0.1"),
+		net.ParseIP("2001:218::1"),
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := state.record(ips[(i+n)%len(ips)]); err != nil {
+					t.Errorf("lookup during reload: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		touchFile(t, filepath.Join(dir, "GeoIP2-Country-Test.mmdb"))
+		state.dbs.loadGeoIPReaders()
+	}
+	if err := state.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	wg.Wait()
+
+	if state.hasDBReaders() {
+		t.Error("readers still available after stop")
+	}
+}
+
+func TestFailedReloadKeepsReader(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	valid := readTestDatabase(t, "GeoIP2-Country-Test")
+	replaceFile(t, path, valid)
+	d := newDatabases(GeoIP2State{DatabaseDirectory: dir, EditionIDs: []string{"GeoIP2-Country-Test"}})
+	d.loadGeoIPReaders()
+	t.Cleanup(func() { d.Destruct() })
+	loaded := d.readers.Load().reader("GeoIP2-Country-Test")
+
+	corrupt := slices.Clone(valid)
+	for i := range 256 {
+		corrupt[i] = 0xff
+	}
+	for name, data := range map[string][]byte{
+		"truncated":  valid[:len(valid)/2],
+		"corrupt":    corrupt,
+		"other type": readTestDatabase(t, "GeoLite2-ASN-Test"),
+	} {
+		replaceFile(t, path, data)
+		d.loadGeoIPReaders()
+		if d.readers.Load().reader("GeoIP2-Country-Test") != loaded {
+			t.Errorf("%s file replaced the loaded reader", name)
+		}
+	}
+	if _, err := d.record(net.ParseIP("81.2.69.160")); err != nil {
+		t.Fatalf("looking up with the kept reader: %v", err)
+	}
+
+	replaceFile(t, path, valid)
+	touchFile(t, path)
+	d.loadGeoIPReaders()
+	if d.readers.Load().reader("GeoIP2-Country-Test") == loaded {
+		t.Error("valid file did not replace the loaded reader")
+	}
+}
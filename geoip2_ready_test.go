@@ -0,0 +1,107 @@
+package geoip2
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestWaitForDatabases(t *testing.T) {
+	state := &GeoIP2State{
+		DatabaseDirectory: "replacer/test-data/test-data",
+		EditionIDs:        []string{"GeoIP2-Country-Test", "GeoLite2-ASN-Test"},
+		WaitForDatabases:  caddy.Duration(5 * time.Second),
+	}
+	if err := state.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !state.isReady() {
+		t.Error("state not ready after waiting for databases")
+	}
+	if err := state.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := &GeoIP2State{
+		DatabaseDirectory: "replacer/test-data/test-data",
+		EditionIDs:        []string{"GeoIP2-Country-Test", "Missing-Edition"},
+		WaitForDatabases:  caddy.Duration(100 * time.Millisecond),
+	}
+	if err := missing.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	err := missing.Start()
+	if err == nil || !strings.Contains(err.Error(), "Missing-Edition") {
+		t.Fatalf("expected startup to fail for the missing edition, got %v", err)
+	}
+	if err := missing.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if missing.hasDBReaders() {
+		t.Error("readers still available after cleanup")
+	}
+}
+
+func TestNotReadyPolicy(t *testing.T) {
+	state := newTestState(t, "GeoIP2-Country-Test", "Missing-Edition")
+	if state.isReady() {
+		t.Fatal("state ready with a missing edition")
+	}
+
+	reject := &GeoIP2{NotReady: notReadyReject, state: state, mode: modeStrict}
+	err := reject.ServeHTTP(httptest.NewRecorder(), newGeoRequest(nil), nextHandler)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("reject: expected status 503, got %v", err)
+	}
+
+	fallback := &GeoIP2{
+		NotReady: notReadyFallback,
+		Fallback: map[string]string{"country_code": "--"},
+		state:    state,
+		mode:     modeStrict,
+	}
+	req := newGeoRequest(nil)
+	if err := fallback.ServeHTTP(httptest.NewRecorder(), req, nextHandler); err != nil {
+		t.Fatal(err)
+	}
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if got, _ := repl.GetString("geoip2.country_code"); got != "--" {
+		t.Errorf("fallback: geoip2.country_code = %q, want %q", got, "--")
+	}
+	if ready, _ := repl.Get("geoip2.ready"); ready != false {
+		t.Errorf("fallback: geoip2.ready = %v, want false", ready)
+	}
+}
+
+func TestNotReadyCaddyfile(t *testing.T) {
+	m := &GeoIP2{}
+	d := caddyfile.NewTestDispenser(`
+	geoip2_vars strict {
+		not_ready fallback
+		fallback geoip2.country_code --
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if m.Enable != "strict" || m.NotReady != notReadyFallback || m.Fallback["country_code"] != "--" {
+		t.Fatalf("unexpected handler: %+v", m)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&GeoIP2{NotReady: "maybe"}).Validate(); err == nil {
+		t.Error("expected an unknown not_ready policy to be invalid")
+	}
+}
@@ -0,0 +1,304 @@
+package geoip2
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// updateStateFile is the name of the file in the database directory
+// that persists the update schedule across restarts.
+const updateStateFile = "geoip2-update-state.json"
+
+// startupCheckInterval is the minimum time between two update checks
+// on start when no update frequency is configured, so that frequent
+// restarts do not use up the download quota.
+const startupCheckInterval = 24 * time.Hour
+
+// failedCheckRetry is the wait before a failed check is retried. It
+// doubles with every further failure, up to the next scheduled check.
+const failedCheckRetry = 5 * time.Minute
+
+// updateState is the persisted update schedule of all databases.
+type updateState struct {
+	Databases map[string]*databaseUpdateState `json:"databases"`
+}
+
+// databaseUpdateState is the persisted update schedule of a database.
+type databaseUpdateState struct {
+	// LastCheck is when an update was last attempted.
+	LastCheck time.Time `json:"last_check,omitzero"`
+	// LastSuccess is when an update last completed,
+	// whether or not a new database was downloaded.
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	// MD5 is the checksum of the database file after the last success.
+	MD5 string `json:"md5,omitempty"`
+	// ETag is the entity tag of the database file after the last success.
+	ETag string `json:"etag,omitempty"`
+	// LastError is the error of the last check, if it failed.
+	LastError string `json:"last_error,omitempty"`
+	// Failures is the number of consecutive failed checks.
+	Failures int `json:"failures,omitempty"`
+}
+
+// failed records a failed check.
+func (ds *databaseUpdateState) failed(err error) {
+	ds.LastError = err.Error()
+	ds.Failures++
+}
+
+// loadUpdateState reads the update state from path. A missing
+// file results in an empty state.
+func loadUpdateState(path string) (*updateState, error) {
+	state := &updateState{Databases: make(map[string]*databaseUpdateState)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return state, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	if state.Databases == nil {
+		state.Databases = make(map[string]*databaseUpdateState)
+	}
+	return state, nil
+}
+
+// save atomically replaces the update state file at path.
+func (s *updateState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// database returns the state of the named database, creating it if needed.
+func (s *updateState) database(name string) *databaseUpdateState {
+	ds, ok := s.Databases[name]
+	if !ok {
+		ds = &databaseUpdateState{}
+		s.Databases[name] = ds
+	}
+	return ds
+}
+
+// due reports whether the named database, stored at filePath, has to be
+// checked for updates at now. Missing databases are always due.
+func (s *updateState) due(name, filePath string, sched *updateSchedule, now time.Time) bool {
+	if _, err := os.Stat(filePath); err != nil {
+		return true
+	}
+	return !now.Before(sched.next(s.Databases[name], now))
+}
+
+// next returns how long to wait until the first database is due,
+// given the update schedules of the databases by name.
+func (s *updateState) next(schedules map[string]*updateSchedule, now time.Time) time.Duration {
+	wait := time.Duration(math.MaxInt64)
+	for name, sched := range schedules {
+		wait = min(wait, sched.next(s.Databases[name], now).Sub(now))
+	}
+	return max(wait, 0)
+}
+
+// updateSchedule returns the update schedule of db configured in g,
+// with scheduled checks delayed by splay.
+func (g *GeoIP2State) updateSchedule(db *DatabaseConfig, splay time.Duration) (*updateSchedule, error) {
+	sched := &updateSchedule{interval: time.Duration(db.UpdateFrequency), splay: splay, loc: time.Local}
+	if g.UpdateTimezone != "" {
+		loc, err := time.LoadLocation(g.UpdateTimezone)
+		if err != nil {
+			return nil, fmt.Errorf("update_timezone: %w", err)
+		}
+		sched.loc = loc
+	}
+	if db.UpdateSchedule != "" {
+		cron, err := parseCron(db.UpdateSchedule)
+		if err != nil {
+			return nil, err
+		}
+		sched.cron, sched.interval = cron, 0
+	}
+	for _, w := range g.UpdateWindows {
+		uw, err := w.parse()
+		if err != nil {
+			return nil, fmt.Errorf("update window: %w", err)
+		}
+		sched.windows = append(sched.windows, uw)
+	}
+	return sched, nil
+}
+
+// UpdateWindow is a maintenance window, a daily period of time
+// within which updates are allowed.
+type UpdateWindow struct {
+	// Start is the time of day the window opens, as "15:04".
+	Start string `json:"start"`
+	// End is the time of day the window closes, as "15:04". Windows
+	// ending before they start close on the next day.
+	End string `json:"end"`
+	// Days are the days of the week the window opens on, in the syntax
+	// of the day of week field of cron expressions, e.g. "mon-fri" or
+	// "sat,sun". Defaults to every day.
+	Days string `json:"days,omitempty"`
+}
+
+// updateWindow is a parsed UpdateWindow.
+type updateWindow struct {
+	// start is the minute of the day the window opens.
+	start  int
+	length time.Duration
+	days   uint64
+}
+
+// parse parses the window.
+func (w *UpdateWindow) parse() (updateWindow, error) {
+	var uw updateWindow
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return uw, fmt.Errorf("invalid window start %q", w.Start)
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return uw, fmt.Errorf("invalid window end %q", w.End)
+	}
+	uw.start = start.Hour()*60 + start.Minute()
+	uw.length = end.Sub(start)
+	if uw.length <= 0 {
+		uw.length += 24 * time.Hour
+	}
+	days := w.Days
+	if days == "" {
+		days = "*"
+	}
+	if uw.days, err = cronDow.parse(days); err != nil {
+		return uw, err
+	}
+	if uw.days&(1<<7) != 0 {
+		uw.days |= 1
+	}
+	return uw, nil
+}
+
+// updateSchedule decides when a database is checked for updates.
+type updateSchedule struct {
+	// interval is the time between checks, if cron is nil.
+	// Without an interval, the database is checked on start,
+	// at most every startupCheckInterval.
+	interval time.Duration
+	cron     *cronSchedule
+	// splay delays the scheduled checks.
+	splay   time.Duration
+	windows []updateWindow
+	loc     *time.Location
+}
+
+// periodic reports whether the database is checked while running.
+func (s *updateSchedule) periodic() bool {
+	return s.interval > 0 || s.cron != nil
+}
+
+// next returns when a database with the update state ds is checked next.
+// Unchecked databases are checked right away, failed checks are retried
+// with backoff, and checks outside of the maintenance windows are
+// deferred to the next window.
+func (s *updateSchedule) next(ds *databaseUpdateState, now time.Time) time.Time {
+	if ds == nil || ds.LastCheck.IsZero() || ds.LastCheck.After(now) {
+		return now
+	}
+	var t time.Time
+	switch {
+	case s.cron != nil:
+		// The splay is subtracted first, so that it does not add up.
+		t = s.cron.next(ds.LastCheck.Add(-s.splay).In(s.loc))
+		if t.IsZero() {
+			t = ds.LastCheck.Add(startupCheckInterval)
+		}
+		t = t.Add(s.splay)
+	case s.interval > 0:
+		t = ds.LastCheck.Add(s.interval + s.splay)
+	default:
+		t = ds.LastCheck.Add(startupCheckInterval)
+	}
+	if ds.Failures > 0 {
+		t = minTime(t, ds.LastCheck.Add(failedCheckRetry<<min(ds.Failures-1, 16)))
+	}
+	return s.window(t)
+}
+
+// window returns t if it is within a maintenance window or
+// no windows are configured, and otherwise the next time
+// a window opens, delayed by the splay within the window.
+func (s *updateSchedule) window(t time.Time) time.Time {
+	if len(s.windows) == 0 {
+		return t
+	}
+	local := t.In(s.loc)
+	var next, opens time.Time
+	// Windows opening the day before may still be open at t.
+	for day := -1; day <= 7; day++ {
+		date := time.Date(local.Year(), local.Month(), local.Day()+day, 0, 0, 0, 0, s.loc)
+		for _, w := range s.windows {
+			if w.days&(1<<int(date.Weekday())) == 0 {
+				continue
+			}
+			start := time.Date(date.Year(), date.Month(), date.Day(), 0, w.start, 0, 0, s.loc)
+			end := start.Add(w.length)
+			if !t.Before(start) && t.Before(end) {
+				return t
+			}
+			if start.After(t) && (opens.IsZero() || start.Before(opens)) {
+				opens, next = start, start.Add(s.splay%w.length)
+			}
+		}
+	}
+	if next.IsZero() {
+		return t
+	}
+	return next
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// fileMD5 returns the hex encoded MD5 checksum of the file at path.
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
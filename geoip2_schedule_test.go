@@ -0,0 +1,276 @@
+package geoip2
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// newUpdateServer serves the test database for any edition the way the
+// MaxMind update endpoint does. It counts the update requests received.
+func newUpdateServer(t *testing.T, requests *atomic.Int64) *httptest.Server {
+	t.Helper()
+	const dbPath = "replacer/test-data/test-data/GeoIP2-Country-Test.mmdb"
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := fileMD5(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Query().Get("db_md5") == sum {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("X-Database-MD5", sum)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(time.RFC1123))
+		gz := gzip.NewWriter(w)
+		gz.Write(data)
+		gz.Close()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestUpdateStatePersisted(t *testing.T) {
+	var requests atomic.Int64
+	srv := newUpdateServer(t, &requests)
+	dir := t.TempDir()
+
+	run := func() *updateState {
+		d := newDatabases(GeoIP2State{
+			AccountID:         1,
+			LicenseKey:        "key",
+			DatabaseDirectory: dir,
+			LockFile:          filepath.Join(dir, "geoip2.lock"),
+			EditionIDs:        []string{"GeoIP2-Country-Test"},
+			UpdateURL:         srv.URL,
+		})
+		d.wg.Add(1)
+		d.runGeoIPUpdate()
+		if err := d.Destruct(); err != nil {
+			t.Fatal(err)
+		}
+		state, err := loadUpdateState(filepath.Join(dir, updateStateFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+
+	state := run()
+	if requests.Load() != 1 {
+		t.Fatalf("expected the missing database to be downloaded, got %d requests", requests.Load())
+	}
+	es := state.Databases["GeoIP2-Country-Test"]
+	if es == nil || es.LastSuccess.IsZero() || es.MD5 == "" || es.LastError != "" {
+		t.Fatalf("unexpected database state: %+v", es)
+	}
+
+	// A restart does not check again before the database is due.
+	run()
+	if requests.Load() != 1 {
+		t.Errorf("restart checked for updates of a recent database, got %d requests", requests.Load())
+	}
+}
+
+func TestUpdateStateSchedule(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	now := time.Now()
+	state := &updateState{Databases: map[string]*databaseUpdateState{
+		"GeoIP2-Country-Test": {LastCheck: now.Add(-time.Hour)},
+	}}
+	every := func(interval time.Duration) *updateSchedule {
+		return &updateSchedule{interval: interval, loc: time.Local}
+	}
+
+	if !state.due("GeoIP2-Country-Test", filePath, every(2*time.Hour), now) {
+		t.Error("missing database not due")
+	}
+	if err := os.WriteFile(filePath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if state.due("GeoIP2-Country-Test", filePath, every(2*time.Hour), now) {
+		t.Error("database due before its interval elapsed")
+	}
+	if !state.due("GeoIP2-Country-Test", filePath, every(30*time.Minute), now) {
+		t.Error("database not due after its interval elapsed")
+	}
+	if state.due("GeoIP2-Country-Test", filePath, every(0), now) {
+		t.Error("database checked on start within a day of its last check")
+	}
+
+	schedules := map[string]*updateSchedule{"GeoIP2-Country-Test": every(2 * time.Hour)}
+	if got := state.next(schedules, now); got != time.Hour {
+		t.Errorf("next check in %s, want %s", got, time.Hour)
+	}
+	// Failed checks are retried sooner, backing off exponentially.
+	ds := state.Databases["GeoIP2-Country-Test"]
+	ds.LastCheck = now
+	for failures, want := range []time.Duration{2 * time.Hour, 5 * time.Minute, 10 * time.Minute, 20 * time.Minute} {
+		ds.Failures = failures
+		if got := state.next(schedules, now); got != want {
+			t.Errorf("next check in %s after %d failures, want %s", got, failures, want)
+		}
+	}
+	ds.Failures = 10
+	if got := state.next(schedules, now); got != 2*time.Hour {
+		t.Errorf("next check in %s after 10 failures, want the update interval", got)
+	}
+
+	schedules["GeoLite2-ASN-Test"] = every(4 * time.Hour)
+	if got := state.next(schedules, now); got != 0 {
+		t.Errorf("next check in %s for an unchecked database, want 0", got)
+	}
+}
+
+func TestUpdateScheduleNext(t *testing.T) {
+	// Tuesday, 10:00 UTC.
+	lastCheck := time.Date(2025, 6, 3, 10, 0, 0, 0, time.UTC)
+	ds := &databaseUpdateState{LastCheck: lastCheck}
+	now := lastCheck.Add(time.Minute)
+	g := &GeoIP2State{UpdateTimezone: "UTC"}
+	schedule := func(t *testing.T, db *DatabaseConfig, splay time.Duration) *updateSchedule {
+		t.Helper()
+		sched, err := g.updateSchedule(db, splay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sched
+	}
+
+	tests := []struct {
+		name    string
+		db      *DatabaseConfig
+		windows []*UpdateWindow
+		splay   time.Duration
+		want    time.Time
+	}{
+		{"cron", &DatabaseConfig{UpdateSchedule: "0 3 * * 2,5"}, nil, 0,
+			time.Date(2025, 6, 6, 3, 0, 0, 0, time.UTC)},
+		{"cron splay", &DatabaseConfig{UpdateSchedule: "0 3 * * tue,fri"}, nil, 20 * time.Minute,
+			time.Date(2025, 6, 6, 3, 20, 0, 0, time.UTC)},
+		{"interval splay", &DatabaseConfig{UpdateFrequency: caddy.Duration(time.Hour)}, nil, 20 * time.Minute,
+			lastCheck.Add(80 * time.Minute)},
+		{"inside window", &DatabaseConfig{UpdateFrequency: caddy.Duration(time.Hour)},
+			[]*UpdateWindow{{Start: "09:00", End: "17:00"}}, 0,
+			lastCheck.Add(time.Hour)},
+		{"deferred to window", &DatabaseConfig{UpdateFrequency: caddy.Duration(time.Hour)},
+			[]*UpdateWindow{{Start: "22:00", End: "02:00"}}, 0,
+			time.Date(2025, 6, 3, 22, 0, 0, 0, time.UTC)},
+		{"deferred to weekend", &DatabaseConfig{UpdateFrequency: caddy.Duration(time.Hour)},
+			[]*UpdateWindow{{Start: "00:00", End: "06:00", Days: "sat,sun"}}, 10 * time.Minute,
+			time.Date(2025, 6, 7, 0, 10, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		g.UpdateWindows = tt.windows
+		if got := schedule(t, tt.db, tt.splay).next(ds, now); !got.Equal(tt.want) {
+			t.Errorf("%s: next check at %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// The splay does not add up with every scheduled check.
+	g.UpdateWindows = nil
+	sched := schedule(t, &DatabaseConfig{UpdateSchedule: "0 3 * * *"}, 20*time.Minute)
+	splayed := &databaseUpdateState{LastCheck: time.Date(2025, 6, 3, 3, 20, 0, 0, time.UTC)}
+	if got, want := sched.next(splayed, now), time.Date(2025, 6, 4, 3, 20, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("next splayed check at %s, want %s", got, want)
+	}
+
+	for _, db := range []*DatabaseConfig{
+		{UpdateSchedule: "0 3 * *"},
+		{UpdateSchedule: "0 24 * * *"},
+		{UpdateSchedule: "*/0 * * * *"},
+		{UpdateSchedule: "0 3 * * mon-sun-tue"},
+	} {
+		if _, err := g.updateSchedule(db, 0); err == nil {
+			t.Errorf("expected cron expression %q to be invalid", db.UpdateSchedule)
+		}
+	}
+	g.UpdateWindows = []*UpdateWindow{{Start: "25:00", End: "02:00"}}
+	if _, err := g.updateSchedule(&DatabaseConfig{}, 0); err == nil {
+		t.Error("expected an invalid window to be invalid")
+	}
+}
+
+func TestScheduleCaddyfile(t *testing.T) {
+	g := &GeoIP2State{}
+	d := caddyfile.NewTestDispenser(`
+	geoip2 {
+		databaseDirectory "/var/lib/geoip"
+		editionID         "GeoLite2-ASN"
+		update_schedule   0 3 * * 2,5
+		update_splay      30m
+		update_window     22:00-06:00
+		update_window     00:00-23:59 sat,sun
+		update_timezone   UTC
+		database city {
+			edition_id       GeoLite2-City
+			update_frequency 12h
+		}
+		database country {
+			edition_id      GeoLite2-Country
+			update_schedule "0 4 * * *"
+		}
+	}`)
+	if err := g.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if g.UpdateSchedule != "0 3 * * 2,5" || time.Duration(g.UpdateSplay) != 30*time.Minute || g.UpdateTimezone != "UTC" {
+		t.Errorf("unexpected schedule: %q, splay %s, time zone %q", g.UpdateSchedule, time.Duration(g.UpdateSplay), g.UpdateTimezone)
+	}
+	if len(g.UpdateWindows) != 2 || *g.UpdateWindows[1] != (UpdateWindow{Start: "00:00", End: "23:59", Days: "sat,sun"}) {
+		t.Errorf("unexpected windows: %+v", g.UpdateWindows)
+	}
+	for _, db := range g.databaseConfigs() {
+		var want string
+		switch db.Name {
+		case "GeoLite2-ASN":
+			want = "0 3 * * 2,5"
+		case "country":
+			want = "0 4 * * *"
+		}
+		if db.UpdateSchedule != want {
+			t.Errorf("database %s scheduled at %q, want %q", db.Name, db.UpdateSchedule, want)
+		}
+	}
+
+	g = &GeoIP2State{}
+	d = caddyfile.NewTestDispenser(`
+	geoip2 {
+		updateFrequency 24h
+	}`)
+	if err := g.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if g.UpdateFrequency != 86400 {
+		t.Errorf("updateFrequency %d, want 86400", g.UpdateFrequency)
+	}
+	g.UpdateSchedule = "@daily"
+	if err := g.Validate(); err == nil {
+		t.Error("expected updateFrequency and update_schedule to be exclusive")
+	}
+
+	d = caddyfile.NewTestDispenser(`
+	geoip2 {
+		updateFrequency 500ms
+	}`)
+	if err := new(GeoIP2State).UnmarshalCaddyfile(d); err == nil {
+		t.Error("sub-second updateFrequency accepted")
+	}
+}
@@ -0,0 +1,213 @@
+package geoip2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// redacted replaces secrets in logged configurations.
+const redacted = "REDACTED"
+
+// resolveSecret replaces the {env.*} and {file.*} placeholders in value.
+// Unknown and empty placeholders are errors, so that a missing variable
+// or file does not silently result in an empty secret.
+func resolveSecret(value string) (string, error) {
+	if !strings.Contains(value, "{") {
+		return value, nil
+	}
+	return caddy.NewReplacer().ReplaceOrErr(value, true, true)
+}
+
+// isPlaceholder reports whether value is a placeholder, which
+// reveals no secret in logs.
+func isPlaceholder(value string) bool {
+	return strings.HasPrefix(value, "{") && strings.HasSuffix(value, "}")
+}
+
+// caddyfileSecret returns the value of the Caddyfile option name for
+// the adapted JSON configuration. Literal secrets are deprecated: they
+// are stored in a file in the data directory, and replaced with a
+// {file.*} placeholder, so that they are not copied into the JSON.
+func caddyfileSecret(d *caddyfile.Dispenser, name, value string) (string, error) {
+	if value == "" || strings.Contains(value, "{") {
+		return value, nil
+	}
+	sum := sha256.Sum256([]byte(value))
+	dir := filepath.Join(caddy.AppDataDir(), moduleName, "secrets")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", d.Errf("storing %s: %v", name, err)
+	}
+	path := filepath.Join(dir, hex.EncodeToString(sum[:16]))
+	if err := os.WriteFile(path, []byte(value), 0o600); err != nil {
+		return "", d.Errf("storing %s: %v", name, err)
+	}
+	caddy.Log().Named(moduleName).Warn("literal secrets in the Caddyfile are deprecated, "+
+		"use an {env.*} or {file.*} placeholder instead",
+		zap.String("option", name), zap.String("stored_in", path))
+	return "{file." + filepath.ToSlash(path) + "}", nil
+}
+
+// caddyfileURLSecret is caddyfileSecret for URLs, which are
+// only secret if they contain a password or a query.
+func caddyfileURLSecret(d *caddyfile.Dispenser, name, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err == nil {
+		if _, ok := u.User.Password(); !ok && u.RawQuery == "" {
+			return rawURL, nil
+		}
+	}
+	return caddyfileSecret(d, name, rawURL)
+}
+
+// redactSecret returns value for logging.
+func redactSecret(value string) string {
+	if value == "" || isPlaceholder(value) {
+		return value
+	}
+	return redacted
+}
+
+// redactURL returns rawURL for logging, without the password it may contain.
+func redactURL(rawURL string) string {
+	if rawURL == "" || isPlaceholder(rawURL) {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	if password, ok := u.User.Password(); ok && !isPlaceholder(password) {
+		return u.Redacted()
+	}
+	return rawURL
+}
+
+// resolveSecrets reads LicenseKeyFile and replaces the placeholders in
+// the secrets of g. The update transport is copied before it is changed,
+// since it may be shared with other configurations.
+func (g *GeoIP2State) resolveSecrets() error {
+	if g.LicenseKeyFile != "" {
+		data, err := os.ReadFile(g.LicenseKeyFile)
+		if err != nil {
+			return fmt.Errorf("reading license_key_file: %w", err)
+		}
+		g.LicenseKey = strings.TrimSpace(string(data))
+		if g.LicenseKey == "" {
+			return fmt.Errorf("license_key_file %s is empty", g.LicenseKeyFile)
+		}
+	}
+	var err error
+	if g.LicenseKey, err = resolveSecret(g.LicenseKey); err != nil {
+		return fmt.Errorf("licenseKey: %w", err)
+	}
+	if g.UpdateTransport != nil && g.UpdateTransport.Proxy != "" {
+		t := *g.UpdateTransport
+		if t.Proxy, err = resolveSecret(t.Proxy); err != nil {
+			return fmt.Errorf("update_transport proxy: %w", err)
+		}
+		g.UpdateTransport = &t
+	}
+	return nil
+}
+
+// configHash returns a hash of the JSON configuration of g. Unlike the
+// JSON itself, it can be used as a key without revealing literal secrets.
+func configHash(config []byte) string {
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:])
+}
+
+// secretsHash returns a hash of the resolved secrets of g, which
+// changes when they are rotated without changing the configuration.
+func (g *GeoIP2State) secretsHash() string {
+	var proxy string
+	if g.UpdateTransport != nil {
+		proxy = g.UpdateTransport.Proxy
+	}
+	sum := sha256.Sum256([]byte(g.LicenseKey + "\x00" + proxy))
+	return hex.EncodeToString(sum[:8])
+}
+
+// redacted returns a copy of g for logging, with its secrets redacted.
+// Placeholders are kept, since they reveal no secret.
+func (g *GeoIP2State) redacted() *GeoIP2State {
+	r := *g
+	r.LicenseKey = redactSecret(g.LicenseKey)
+	if g.UpdateTransport != nil {
+		t := *g.UpdateTransport
+		t.Proxy = redactURL(t.Proxy)
+		r.UpdateTransport = &t
+	}
+	r.Databases = make([]*DatabaseConfig, len(g.Databases))
+	for i, db := range g.Databases {
+		db := *db
+		db.SourceRaw = redactSource(db.SourceRaw)
+		r.Databases[i] = &db
+	}
+	if g.Instances != nil {
+		r.Instances = make(map[string]*GeoIP2State, len(g.Instances))
+		for name, inst := range g.Instances {
+			r.Instances[name] = inst.redacted()
+		}
+	}
+	return &r
+}
+
+// redactSource redacts the credentials in the JSON of a source module:
+// license keys, tokens, header values and URL passwords and queries.
+func redactSource(raw json.RawMessage) json.RawMessage {
+	if raw == nil {
+		return nil
+	}
+	var src map[string]any
+	if err := json.Unmarshal(raw, &src); err != nil {
+		return nil
+	}
+	for key, value := range src {
+		switch key {
+		case "license_key", "token":
+			if s, ok := value.(string); ok {
+				src[key] = redactSecret(s)
+			}
+		case "url":
+			if s, ok := value.(string); ok && !isPlaceholder(s) {
+				u, err := url.Parse(s)
+				if err != nil {
+					src[key] = redacted
+					continue
+				}
+				if u.RawQuery != "" {
+					u.RawQuery = redacted
+				}
+				src[key] = u.Redacted()
+			}
+		case "header":
+			if header, ok := value.(map[string]any); ok {
+				for field, values := range header {
+					list, _ := values.([]any)
+					for i, v := range list {
+						if s, ok := v.(string); ok {
+							list[i] = redactSecret(s)
+						}
+					}
+					header[field] = list
+				}
+			}
+		}
+	}
+	out, err := json.Marshal(src)
+	if err != nil {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,481 @@
+package geoip2
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate/database"
+)
+
+// Source downloads database files. Sources are modules in the
+// geoip2.sources namespace, configured in the source of a database.
+// They are provisioned with the first configuration using the
+// databases and shared by later configurations with the same
+// databases, so they must not depend on the lifetime of their context.
+type Source interface {
+	// Download writes the database to req.Candidate, unless the current
+	// database file is up to date. Download must return when ctx is done.
+	Download(ctx context.Context, req SourceRequest) (SourceResult, error)
+}
+
+// SourceRequest describes a database to download.
+type SourceRequest struct {
+	// Database is the name of the database.
+	Database string
+	// EditionID is the edition of the database, if any.
+	EditionID string
+	// Current is the path of the current database file, which may not exist.
+	Current string
+	// CurrentMD5 is the hex encoded MD5 checksum of the current database
+	// file, or database.ZeroMD5 if it does not exist.
+	CurrentMD5 string
+	// ETag is the entity tag of the current database file, if known.
+	ETag string
+	// Candidate is the path to write the downloaded database to.
+	Candidate string
+	// LockFile is the lock file that serializes the downloads.
+	LockFile string
+	// Client is the HTTP client to download with.
+	Client *http.Client
+}
+
+// SourceResult describes the outcome of a download.
+type SourceResult struct {
+	// Downloaded reports whether the database was written to the candidate.
+	Downloaded bool
+	// ETag is the entity tag of the database, if the server sent one.
+	ETag string
+}
+
+func init() {
+	caddy.RegisterModule(URLSource{})
+	caddy.RegisterModule(DBIPSource{})
+	caddy.RegisterModule(IPinfoSource{})
+}
+
+// URLSource downloads a database from an HTTP(S) or file URL. The file
+// may be an .mmdb file, gzip compressed, or a (gzip compressed) tar
+// archive containing the database.
+type URLSource struct {
+	// URL is the http://, https:// or file:// URL of the database.
+	URL string `json:"url,omitempty"`
+	// Member is the name of the database in a tar archive.
+	// Defaults to the first .mmdb file in the archive.
+	Member string `json:"member,omitempty"`
+	// Header is added to HTTP requests, e.g. for authentication.
+	// The URL and header values may contain {env.*} and {file.*}
+	// placeholders, which are resolved on provision.
+	Header http.Header `json:"header,omitempty"`
+}
+
+// CaddyModule implements caddy.Module.
+func (URLSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "geoip2.sources.url",
+		New: func() caddy.Module { return new(URLSource) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (s *URLSource) Provision(caddy.Context) error {
+	var err error
+	if s.URL, err = resolveSecret(s.URL); err != nil {
+		return fmt.Errorf("url: %w", err)
+	}
+	header := make(http.Header, len(s.Header))
+	for field, values := range s.Header {
+		for _, value := range values {
+			if value, err = resolveSecret(value); err != nil {
+				return fmt.Errorf("header %s: %w", field, err)
+			}
+			header.Add(field, value)
+		}
+	}
+	s.Header = header
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (s *URLSource) Validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "file":
+		return nil
+	default:
+		return fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+}
+
+// Download implements Source.
+func (s *URLSource) Download(ctx context.Context, req SourceRequest) (SourceResult, error) {
+	return downloadURL(ctx, req, s.URL, s.Header, s.Member)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	source url <url> {
+//	    member <name>
+//	    header <field> <value>
+//	}
+func (s *URLSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume source name
+	if !d.Args(&s.URL) || d.NextArg() {
+		return d.ArgErr()
+	}
+	var err error
+	if s.URL, err = caddyfileURLSecret(d, "url", s.URL); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "member":
+			if !d.Args(&s.Member) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "header":
+			var field, value string
+			if !d.Args(&field, &value) || d.NextArg() {
+				return d.ArgErr()
+			}
+			// Header values are redacted like secrets, as
+			// they usually carry credentials.
+			if value, err = caddyfileSecret(d, "header "+field, value); err != nil {
+				return err
+			}
+			if s.Header == nil {
+				s.Header = make(http.Header)
+			}
+			s.Header.Add(field, value)
+		default:
+			return d.Errf("unrecognized url source subdirective %q", d.Val())
+		}
+	}
+	return nil
+}
+
+// DBIPSource downloads the free monthly databases of DB-IP.
+type DBIPSource struct {
+	// Edition is the DB-IP database, one of "city-lite",
+	// "country-lite" and "asn-lite".
+	Edition string `json:"edition,omitempty"`
+	// URL is the base URL of the downloads.
+	// Defaults to https://download.db-ip.com/free.
+	URL string `json:"url,omitempty"`
+}
+
+// CaddyModule implements caddy.Module.
+func (DBIPSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "geoip2.sources.dbip",
+		New: func() caddy.Module { return new(DBIPSource) },
+	}
+}
+
+// Validate implements caddy.Validator.
+func (s *DBIPSource) Validate() error {
+	switch s.Edition {
+	case "city-lite", "country-lite", "asn-lite":
+		return nil
+	default:
+		return fmt.Errorf("unknown DB-IP edition %q", s.Edition)
+	}
+}
+
+// Download implements Source. The database of the current month is
+// downloaded, or the one of the previous month if it is not yet published.
+func (s *DBIPSource) Download(ctx context.Context, req SourceRequest) (SourceResult, error) {
+	base := s.URL
+	if base == "" {
+		base = "https://download.db-ip.com/free"
+	}
+	now := time.Now().UTC()
+	var err error
+	for _, month := range []time.Time{now, now.AddDate(0, 0, -now.Day())} {
+		u := fmt.Sprintf("%s/dbip-%s-%s.mmdb.gz", strings.TrimSuffix(base, "/"), s.Edition, month.Format("2006-01"))
+		var result SourceResult
+		result, err = downloadURL(ctx, req, u, nil, "")
+		if !errors.Is(err, errNotFound) {
+			return result, err
+		}
+	}
+	return SourceResult{}, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	source dbip <edition> {
+//	    url <base url>
+//	}
+func (s *DBIPSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume source name
+	if !d.Args(&s.Edition) || d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "url":
+			if !d.Args(&s.URL) || d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized dbip source subdirective %q", d.Val())
+		}
+	}
+	return nil
+}
+
+// IPinfoSource downloads the free databases of IPinfo.
+type IPinfoSource struct {
+	// Token is the IPinfo access token. It may be an {env.*}
+	// or {file.*} placeholder, which is resolved on provision.
+	Token string `json:"token,omitempty"`
+	// Database is the name of the database. Defaults to "ipinfo_lite".
+	Database string `json:"database,omitempty"`
+	// URL is the base URL of the downloads.
+	// Defaults to https://ipinfo.io/data.
+	URL string `json:"url,omitempty"`
+}
+
+// CaddyModule implements caddy.Module.
+func (IPinfoSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "geoip2.sources.ipinfo",
+		New: func() caddy.Module { return new(IPinfoSource) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (s *IPinfoSource) Provision(caddy.Context) error {
+	var err error
+	if s.Token, err = resolveSecret(s.Token); err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (s *IPinfoSource) Validate() error {
+	if s.Token == "" {
+		return errors.New("missing IPinfo token")
+	}
+	return nil
+}
+
+// Download implements Source.
+func (s *IPinfoSource) Download(ctx context.Context, req SourceRequest) (SourceResult, error) {
+	base, name := s.URL, s.Database
+	if base == "" {
+		base = "https://ipinfo.io/data"
+	}
+	if name == "" {
+		name = "ipinfo_lite"
+	}
+	u := fmt.Sprintf("%s/%s.mmdb?token=%s", strings.TrimSuffix(base, "/"), url.PathEscape(name), url.QueryEscape(s.Token))
+	return downloadURL(ctx, req, u, nil, "")
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	source ipinfo <token> {
+//	    database <name>
+//	    url      <base url>
+//	}
+func (s *IPinfoSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume source name
+	if !d.Args(&s.Token) || d.NextArg() {
+		return d.ArgErr()
+	}
+	var err error
+	if s.Token, err = caddyfileSecret(d, "token", s.Token); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "database":
+			if !d.Args(&s.Database) || d.NextArg() {
+				return d.ArgErr()
+			}
+		case "url":
+			if !d.Args(&s.URL) || d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized ipinfo source subdirective %q", d.Val())
+		}
+	}
+	return nil
+}
+
+// errNotFound is returned by downloadURL if the server responds with 404.
+var errNotFound = errors.New("database not found")
+
+// downloadURL downloads the database at rawURL to req.Candidate, extracting
+// it from an archive if needed. HTTP requests are conditional on the
+// modification time and entity tag of the current database file, and
+// downloads that match the current database are discarded.
+func downloadURL(ctx context.Context, req SourceRequest, rawURL string, header http.Header, member string) (SourceResult, error) {
+	lock, err := database.CreateLockFile(req.LockFile, false)
+	if err != nil {
+		return SourceResult{}, err
+	}
+	defer lock.Unlock()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return SourceResult{}, err
+	}
+	// Errors leave out the query, which may contain an access token.
+	where := u.Host + u.Path
+	var body io.ReadCloser
+	var modTime time.Time
+	var etag string
+	if u.Scheme == "file" {
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return SourceResult{}, err
+		}
+		body = f
+	} else {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return SourceResult{}, err
+		}
+		for field, values := range header {
+			httpReq.Header[field] = values
+		}
+		if info, err := os.Stat(req.Current); err == nil {
+			httpReq.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+		}
+		if req.ETag != "" {
+			httpReq.Header.Set("If-None-Match", req.ETag)
+		}
+		resp, err := req.Client.Do(httpReq)
+		if err != nil {
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			return SourceResult{}, fmt.Errorf("downloading %s: %w", where, err)
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotModified:
+			return SourceResult{ETag: req.ETag}, nil
+		case http.StatusNotFound:
+			return SourceResult{}, fmt.Errorf("downloading %s: %w", where, errNotFound)
+		default:
+			return SourceResult{}, fmt.Errorf("downloading %s: unexpected status %s", where, resp.Status)
+		}
+		body = resp.Body
+		modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+		etag = resp.Header.Get("ETag")
+	}
+	defer body.Close()
+
+	f, err := os.OpenFile(req.Candidate, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return SourceResult{}, err
+	}
+	err = extractDatabase(body, f, member)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !modTime.IsZero() {
+		err = os.Chtimes(req.Candidate, modTime, modTime)
+	}
+	var sum string
+	if err == nil {
+		sum, err = fileMD5(req.Candidate)
+	}
+	if err != nil {
+		os.Remove(req.Candidate)
+		return SourceResult{}, err
+	}
+	if sum == req.CurrentMD5 {
+		os.Remove(req.Candidate)
+		return SourceResult{ETag: etag}, nil
+	}
+	return SourceResult{Downloaded: true, ETag: etag}, nil
+}
+
+// extractDatabase copies the database in r to w. If r is gzip compressed
+// it is decompressed, and if it is a tar archive, the member with the
+// given name, or the first .mmdb file, is extracted.
+func extractDatabase(r io.Reader, w io.Writer, member string) error {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("decompressing database: %w", err)
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	// Tar archives are identified by the magic of their first header.
+	if header, _ := br.Peek(262); len(header) < 262 || string(header[257:262]) != "ustar" {
+		if member != "" {
+			return fmt.Errorf("member %q requested, but the download is no tar archive", member)
+		}
+		_, err := io.Copy(w, br)
+		return err
+	}
+	tr := tar.NewReader(br)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading archive: %w", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if member != "" && h.Name != member && path.Base(h.Name) != member {
+			continue
+		}
+		if member == "" && !strings.HasSuffix(h.Name, ".mmdb") {
+			continue
+		}
+		_, err = io.Copy(w, tr)
+		return err
+	}
+	if member != "" {
+		return fmt.Errorf("member %q not found in archive", member)
+	}
+	return errors.New("no .mmdb file found in archive")
+}
+
+// Interface guards.
+var (
+	_ Source                = (*URLSource)(nil)
+	_ caddy.Provisioner     = (*URLSource)(nil)
+	_ caddy.Validator       = (*URLSource)(nil)
+	_ caddyfile.Unmarshaler = (*URLSource)(nil)
+	_ Source                = (*DBIPSource)(nil)
+	_ caddy.Validator       = (*DBIPSource)(nil)
+	_ caddyfile.Unmarshaler = (*DBIPSource)(nil)
+	_ Source                = (*IPinfoSource)(nil)
+	_ caddy.Provisioner     = (*IPinfoSource)(nil)
+	_ caddy.Validator       = (*IPinfoSource)(nil)
+	_ caddyfile.Unmarshaler = (*IPinfoSource)(nil)
+)
@@ -0,0 +1,293 @@
+package geoip2
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate/database"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarData(t *testing.T, files map[string][]byte, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractDatabase(t *testing.T) {
+	db := readTestDatabase(t, "GeoIP2-Country-Test")
+	asn := readTestDatabase(t, "GeoLite2-ASN-Test")
+	archive := tarData(t, map[string][]byte{
+		"GeoLite2-Country_20250101/LICENSE.txt":           []byte("license"),
+		"GeoLite2-Country_20250101/GeoLite2-Country.mmdb": db,
+		"GeoLite2-Country_20250101/GeoLite2-ASN.mmdb":     asn,
+	}, "GeoLite2-Country_20250101/LICENSE.txt",
+		"GeoLite2-Country_20250101/GeoLite2-Country.mmdb",
+		"GeoLite2-Country_20250101/GeoLite2-ASN.mmdb")
+
+	tests := []struct {
+		name   string
+		data   []byte
+		member string
+		want   []byte
+	}{
+		{"mmdb", db, "", db},
+		{"mmdb.gz", gzipData(t, db), "", db},
+		{"tar", archive, "", db},
+		{"tar.gz", gzipData(t, archive), "", db},
+		{"tar.gz member", gzipData(t, archive), "GeoLite2-ASN.mmdb", asn},
+		{"tar.gz member path", gzipData(t, archive), "GeoLite2-Country_20250101/GeoLite2-ASN.mmdb", asn},
+		{"tar.gz missing member", gzipData(t, archive), "GeoLite2-City.mmdb", nil},
+		{"mmdb member", db, "GeoLite2-ASN.mmdb", nil},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := extractDatabase(bytes.NewReader(tt.data), &buf, tt.member)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !bytes.Equal(buf.Bytes(), tt.want) {
+			t.Errorf("%s: extracted the wrong database", tt.name)
+		}
+	}
+}
+
+// newSourceRequest returns a request to download the database to dir.
+func newSourceRequest(t *testing.T, dir string) SourceRequest {
+	t.Helper()
+	path := filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	sum, err := fileMD5(path)
+	if err != nil {
+		sum = database.ZeroMD5
+	}
+	return SourceRequest{
+		Database:   "GeoIP2-Country-Test",
+		Current:    path,
+		CurrentMD5: sum,
+		Candidate:  path + candidateSuffix,
+		LockFile:   filepath.Join(dir, "geoip2.lock"),
+		Client:     http.DefaultClient,
+	}
+}
+
+// promote moves the downloaded candidate of req into place.
+func promote(t *testing.T, req SourceRequest) {
+	t.Helper()
+	if err := os.Rename(req.Candidate, req.Current); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestURLSource(t *testing.T) {
+	data := gzipData(t, readTestDatabase(t, "GeoIP2-Country-Test"))
+	lastModified := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, "db.mmdb.gz", lastModified, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	src := &URLSource{URL: srv.URL + "/db.mmdb.gz", Header: http.Header{"Authorization": {"Bearer secret"}}}
+	req := newSourceRequest(t, dir)
+	if result, err := src.Download(context.Background(), req); err != nil || !result.Downloaded {
+		t.Fatalf("downloaded %v: %v", result.Downloaded, err)
+	}
+	info, err := os.Stat(req.Candidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(lastModified) {
+		t.Errorf("candidate modified at %s, want %s", info.ModTime(), lastModified)
+	}
+	promote(t, req)
+
+	// The download is conditional on the modification time.
+	req = newSourceRequest(t, dir)
+	if result, err := src.Download(context.Background(), req); err != nil || result.Downloaded {
+		t.Fatalf("downloaded %v an unchanged database: %v", result.Downloaded, err)
+	}
+
+	src.Header = nil
+	if _, err := src.Download(context.Background(), req); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("unexpected error for an unauthorized download: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+
+	// File URLs are copied and unchanged files are discarded.
+	src = &URLSource{URL: "file://" + req.Current}
+	if result, err := src.Download(context.Background(), req); err != nil || result.Downloaded {
+		t.Fatalf("downloaded %v an unchanged database: %v", result.Downloaded, err)
+	}
+	if _, err := os.Stat(req.Candidate); err == nil {
+		t.Error("unchanged candidate left behind")
+	}
+}
+
+func TestDBIPSource(t *testing.T) {
+	data := gzipData(t, readTestDatabase(t, "GeoIP2-Country-Test"))
+	now := time.Now().UTC()
+	// Only the database of the previous month is published.
+	want := "/free/dbip-country-lite-" + now.AddDate(0, 0, -now.Day()).Format("2006-01") + ".mmdb.gz"
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path != want {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	src := &DBIPSource{Edition: "country-lite", URL: srv.URL + "/free"}
+	if err := src.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	req := newSourceRequest(t, t.TempDir())
+	if result, err := src.Download(context.Background(), req); err != nil || !result.Downloaded {
+		t.Fatalf("downloaded %v: %v", result.Downloaded, err)
+	}
+	if len(paths) != 2 || paths[1] != want {
+		t.Errorf("requested %v", paths)
+	}
+}
+
+func TestIPinfoSource(t *testing.T) {
+	data := readTestDatabase(t, "GeoIP2-Country-Test")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/data/ipinfo_lite.mmdb" || r.URL.Query().Get("token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	req := newSourceRequest(t, t.TempDir())
+	src := &IPinfoSource{Token: "secret", URL: srv.URL + "/data"}
+	if result, err := src.Download(context.Background(), req); err != nil || !result.Downloaded {
+		t.Fatalf("downloaded %v: %v", result.Downloaded, err)
+	}
+
+	src.Token = "wrong"
+	_, err := src.Download(context.Background(), req)
+	if err == nil {
+		t.Fatal("expected an error for a forbidden download")
+	}
+	if strings.Contains(err.Error(), "wrong") {
+		t.Errorf("error contains the token: %v", err)
+	}
+}
+
+func TestSourceCaddyfile(t *testing.T) {
+	dir := t.TempDir()
+	upstream := filepath.Join(dir, "country.mmdb.gz")
+
+	g := &GeoIP2State{}
+	d := caddyfile.NewTestDispenser(`
+	geoip2 {
+		databaseDirectory ` + dir + `
+		lockFile          ` + filepath.Join(dir, "geoip2.lock") + `
+		database country {
+			path   country.mmdb
+			source url file://` + upstream + `
+		}
+		database asn {
+			path   asn.mmdb
+			source dbip asn-lite {
+				url http://127.0.0.1:1/free
+			}
+		}
+	}`)
+	if err := g.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []map[string]string{
+		{"source": "url", "url": "file://" + upstream},
+		{"source": "dbip", "edition": "asn-lite", "url": "http://127.0.0.1:1/free"},
+	} {
+		var got map[string]string
+		if err := json.Unmarshal(g.Databases[i].SourceRaw, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(got, want) {
+			t.Errorf("source %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSourceUpdate(t *testing.T) {
+	dir := t.TempDir()
+	upstream := filepath.Join(t.TempDir(), "country.mmdb.gz")
+	if err := os.WriteFile(upstream, gzipData(t, readTestDatabase(t, "GeoIP2-Country-Test")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDatabases(GeoIP2State{
+		DatabaseDirectory: dir,
+		LockFile:          filepath.Join(dir, "geoip2.lock"),
+		Databases:         []*DatabaseConfig{{Name: "country", Path: "country.mmdb"}},
+	})
+	d.configs[0].source = &URLSource{URL: "file://" + upstream}
+	t.Cleanup(func() { d.Destruct() })
+	d.wg.Add(1)
+	d.runGeoIPUpdate()
+	if _, err := os.Stat(filepath.Join(dir, "country.mmdb")); err != nil {
+		t.Errorf("database not downloaded from its source: %v", err)
+	}
+	if !d.hasDBReaders() {
+		t.Error("downloaded database not loaded")
+	}
+}
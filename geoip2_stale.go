@@ -0,0 +1,202 @@
+package geoip2
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// staleCheckInterval is the interval at which the
+// build ages of the loaded databases are checked.
+const staleCheckInterval = time.Minute
+
+// These are the on_stale policies of the blocking handlers, which
+// apply while geoip2_vars reports a stale database in {geoip2.stale}:
+//   - "serve" decides by the stale data as usual (default).
+//   - "deny" responds with 503 Service Unavailable, or fails the
+//     authentication (geoip2_auth).
+//   - "challenge" challenges every request (geoip2_challenge only).
+//   - "authenticate" ignores the branches and authenticates with the
+//     default providers (geoip2_auth only).
+const (
+	onStaleServe        = "serve"
+	onStaleDeny         = "deny"
+	onStaleChallenge    = "challenge"
+	onStaleAuthenticate = "authenticate"
+)
+
+// errStale is returned by the blocking handlers denying requests.
+var errStale = errors.New("geoip databases are stale")
+
+// requestStale reports whether geoip2_vars found
+// a stale database while handling the request.
+func requestStale(repl *caddy.Replacer) bool {
+	stale, _ := repl.Get("geoip2.stale")
+	return stale == true
+}
+
+// validateOnStale checks that policy is "serve", "deny" or one of the
+// additional policies of the handler.
+func validateOnStale(policy string, additional ...string) error {
+	if policy == "" || policy == onStaleServe || policy == onStaleDeny || slices.Contains(additional, policy) {
+		return nil
+	}
+	return fmt.Errorf("unrecognized on_stale policy %q", policy)
+}
+
+// staleMetrics are the metrics of the database ages, labelled
+// by instance and database. They are shared by all configurations.
+var staleMetrics = struct {
+	age   *prometheus.GaugeVec
+	stale *prometheus.GaugeVec
+}{
+	age: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: moduleName,
+		Name:      "database_age_seconds",
+		Help:      "Age of the loaded database by its build epoch.",
+	}, []string{"instance", "database"}),
+	stale: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: moduleName,
+		Name:      "database_stale",
+		Help:      "Whether the loaded database is older than its max_age.",
+	}, []string{"instance", "database"}),
+}
+
+// staleSeries tracks the live databases publishing the staleness series
+// of each instance and database. During a reload the old and the new
+// configuration share the labels, so that a series is only deleted
+// once the last of them is destructed.
+var staleSeries = struct {
+	mu     sync.Mutex
+	owners map[[2]string]map[*databases]struct{}
+}{owners: make(map[[2]string]map[*databases]struct{})}
+
+// publishStaleSeries records d as an owner of the series of db.
+func (d *databases) publishStaleSeries(db *DatabaseConfig) {
+	labels := [2]string{d.cfg.name, db.Name}
+	staleSeries.mu.Lock()
+	defer staleSeries.mu.Unlock()
+	if staleSeries.owners[labels] == nil {
+		staleSeries.owners[labels] = make(map[*databases]struct{})
+	}
+	staleSeries.owners[labels][d] = struct{}{}
+}
+
+// retireStaleSeries removes d as an owner of the series of its
+// databases, and deletes the series no other databases own.
+func (d *databases) retireStaleSeries() {
+	staleSeries.mu.Lock()
+	defer staleSeries.mu.Unlock()
+	for _, db := range d.configs {
+		labels := [2]string{d.cfg.name, db.Name}
+		owners := staleSeries.owners[labels]
+		delete(owners, d)
+		if len(owners) > 0 {
+			continue
+		}
+		delete(staleSeries.owners, labels)
+		staleMetrics.age.DeleteLabelValues(labels[:]...)
+		staleMetrics.stale.DeleteLabelValues(labels[:]...)
+	}
+}
+
+// registerStaleMetrics registers the staleness metrics with
+// the metrics registry of ctx, if it has one.
+func registerStaleMetrics(ctx caddy.Context) error {
+	registry := ctx.GetMetricsRegistry()
+	if registry == nil {
+		return nil
+	}
+	for _, c := range []prometheus.Collector{staleMetrics.age, staleMetrics.stale} {
+		// Every configuration registers them with its own registry,
+		// and the handlers of a configuration share it.
+		var already prometheus.AlreadyRegisteredError
+		if err := registry.Register(c); err != nil && !errors.As(err, &already) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkStaleness compares the build epochs of the loaded databases
+// with their MaxAge at now. Databases becoming stale are logged and
+// reported as events, and the metrics are updated.
+func (d *databases) checkStaleness(now time.Time) {
+	s := d.acquireReaders()
+	if s != nil {
+		defer s.release()
+	}
+	d.staleMu.Lock()
+	stale := make(map[string]bool)
+	var events []func()
+	for _, db := range d.configs {
+		r := s.reader(db.Name)
+		if r == nil {
+			continue
+		}
+		epoch := r.Metadata().BuildEpoch
+		age := now.Sub(time.Unix(int64(epoch), 0))
+		d.publishStaleSeries(db)
+		staleMetrics.age.WithLabelValues(d.cfg.name, db.Name).Set(age.Seconds())
+		if db.MaxAge == 0 || age <= time.Duration(db.MaxAge) {
+			staleMetrics.stale.WithLabelValues(d.cfg.name, db.Name).Set(0)
+			if d.stale[db.Name] {
+				caddy.Log().Named(moduleName).Info("geoip database no longer stale",
+					zap.String("database", db.Name), zap.Uint("build_epoch", epoch))
+			}
+			continue
+		}
+		stale[db.Name] = true
+		staleMetrics.stale.WithLabelValues(d.cfg.name, db.Name).Set(1)
+		if d.stale[db.Name] {
+			continue
+		}
+		caddy.Log().Named(moduleName).Warn("geoip database is older than its max_age",
+			zap.String("database", db.Name), zap.String("editionID", db.EditionID),
+			zap.Uint("build_epoch", epoch), zap.Duration("age", age), zap.Duration("max_age", time.Duration(db.MaxAge)))
+		data := map[string]any{
+			"reason":      staleMaxAge,
+			"build_epoch": epoch,
+			"age":         age.Seconds(),
+			"max_age":     time.Duration(db.MaxAge).Seconds(),
+		}
+		events = append(events, func() { d.emit(eventDatabaseStale, db, data) })
+	}
+	d.stale = stale
+	d.anyStale.Store(len(stale) > 0)
+	d.staleMu.Unlock()
+	// Event handlers run after the lock is released,
+	// so that they may reload the databases.
+	for _, emit := range events {
+		emit()
+	}
+}
+
+// watchStaleness checks the staleness of the databases periodically
+// until they are destructed, since they age without being reloaded.
+func (d *databases) watchStaleness() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(staleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.checkStaleness(now)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// isStale reports whether a loaded database is older than its MaxAge.
+func (d *databases) isStale() bool {
+	return d.anyStale.Load()
+}
@@ -0,0 +1,274 @@
+package geoip2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStaleness(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "country.mmdb")
+	data := readTestDatabase(t, "GeoIP2-Country-Test")
+	now := time.Now()
+	replaceFile(t, path, withBuildEpoch(t, data, uint32(now.Add(-48*time.Hour).Unix())))
+
+	d := newDatabases(GeoIP2State{
+		DatabaseDirectory: dir,
+		Databases:         []*DatabaseConfig{{Name: "country", Path: "country.mmdb"}},
+		MaxAge:            caddy.Duration(24 * time.Hour),
+	})
+	emitter, h := newRecordingEmitter(t)
+	d.events.Store(emitter)
+	t.Cleanup(func() { d.Destruct() })
+
+	d.loadGeoIPReaders()
+	if !d.isStale() {
+		t.Fatal("database older than its max age not stale")
+	}
+	events := h.take()
+	stale := slices.IndexFunc(events, func(e caddy.Event) bool { return e.Name() == eventDatabaseStale })
+	if stale < 0 {
+		t.Fatalf("no database_stale event in %v", eventNames(events))
+	}
+	if data := events[stale].Data; data["reason"] != staleMaxAge || data["age"].(float64) < (47*time.Hour).Seconds() {
+		t.Errorf("unexpected database_stale data: %v", data)
+	}
+	if got := testutil.ToFloat64(staleMetrics.stale.WithLabelValues("", "country")); got != 1 {
+		t.Errorf("stale metric %v, want 1", got)
+	}
+
+	// Staleness is reported once.
+	d.checkStaleness(time.Now())
+	if got := eventNames(h.take()); len(got) != 0 {
+		t.Errorf("stale database reported again: %v", got)
+	}
+
+	// A newer build clears it.
+	replaceFile(t, path, withBuildEpoch(t, data, uint32(now.Unix())))
+	touchFile(t, path)
+	d.loadGeoIPReaders()
+	if d.isStale() {
+		t.Error("database within its max age stale")
+	}
+	if got := testutil.ToFloat64(staleMetrics.stale.WithLabelValues("", "country")); got != 0 {
+		t.Errorf("stale metric %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(staleMetrics.age.WithLabelValues("", "country")); got > time.Minute.Seconds() {
+		t.Errorf("age metric %v, want less than a minute", got)
+	}
+}
+
+func TestStalenessClearedByWatcher(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "country.mmdb")
+	data := readTestDatabase(t, "GeoIP2-Country-Test")
+	now := time.Now()
+	replaceFile(t, path, withBuildEpoch(t, data, uint32(now.Add(-48*time.Hour).Unix())))
+
+	d := newDatabases(GeoIP2State{
+		DatabaseDirectory: dir,
+		Databases:         []*DatabaseConfig{{Name: "country", Path: "country.mmdb"}},
+		MaxAge:            caddy.Duration(24 * time.Hour),
+	})
+	t.Cleanup(func() { d.Destruct() })
+	d.loadGeoIPReaders()
+	if !d.isStale() {
+		t.Fatal("database older than its max age not stale")
+	}
+
+	replaceFile(t, path, withBuildEpoch(t, data, uint32(now.Unix())))
+	touchFile(t, path)
+	d.reloadChangedDatabase(d.configs[0], make(map[string]fileStamp))
+	if d.isStale() {
+		t.Error("database reloaded by the watcher still stale")
+	}
+	if got := testutil.ToFloat64(staleMetrics.stale.WithLabelValues("", "country")); got != 0 {
+		t.Errorf("stale metric %v, want 0", got)
+	}
+}
+
+func TestStaleSeriesSurviveReload(t *testing.T) {
+	state := GeoIP2State{
+		name:              "reload",
+		DatabaseDirectory: "replacer/test-data/test-data",
+		EditionIDs:        []string{"GeoIP2-Country-Test"},
+	}
+	old := newDatabases(state)
+	old.loadGeoIPReaders()
+	reloaded := newDatabases(state)
+	reloaded.loadGeoIPReaders()
+	series := testutil.CollectAndCount(staleMetrics.age)
+
+	// The old databases are destructed after the new ones took over.
+	old.Destruct()
+	if got := testutil.CollectAndCount(staleMetrics.age); got != series {
+		t.Errorf("%d series after destructing the old databases, want %d", got, series)
+	}
+	reloaded.Destruct()
+	if got := testutil.CollectAndCount(staleMetrics.age); got != series-1 {
+		t.Errorf("%d series after destructing all databases, want %d", got, series-1)
+	}
+}
+
+// newLookupRequest returns a request the geoip2_vars handler looks up.
+func newLookupRequest() *http.Request {
+	req := newGeoRequest(nil)
+	req.RemoteAddr = "81.2.69.160:1234"
+	vars := map[string]any{caddyhttp.TrustedProxyVarKey: false}
+	return req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, vars))
+}
+
+func TestStaleVar(t *testing.T) {
+	state := newTestState(t, "GeoIP2-Country-Test")
+	m := &GeoIP2{state: state, mode: modeStrict}
+	for _, stale := range []bool{true, false} {
+		state.dbs.anyStale.Store(stale)
+		req := newLookupRequest()
+		if err := m.ServeHTTP(httptest.NewRecorder(), req, nextHandler); err != nil {
+			t.Fatalf("stale %t: %v", stale, err)
+		}
+		repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if got, _ := repl.Get("geoip2.stale"); got != stale {
+			t.Errorf("geoip2.stale = %v, want %t", got, stale)
+		}
+	}
+}
+
+func TestOnStaleBlockingHandlers(t *testing.T) {
+	stale := map[string]any{"geoip2.stale": true, "geoip2.country_code": "DE", "geoip2.ip_address": "81.2.69.160"}
+	fresh := map[string]any{"geoip2.stale": false, "geoip2.country_code": "DE", "geoip2.ip_address": "81.2.69.160"}
+	isUnavailable := func(err error) bool {
+		var handlerErr caddyhttp.HandlerError
+		return errors.As(err, &handlerErr) && handlerErr.StatusCode == http.StatusServiceUnavailable
+	}
+
+	// Stale branches do not skip authentication.
+	a := &GeoIP2Auth{
+		Branches:  []*AuthBranch{{Name: "office", GeoCriteria: GeoCriteria{Countries: []string{"DE"}}, Skip: true}},
+		providers: map[string]caddyauth.Authenticator{"basic": tokenAuth("basic")},
+	}
+	if err := a.Branches[0].provision(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		policy string
+		vars   map[string]any
+		token  string
+		authed bool
+	}{
+		{onStaleServe, stale, "", true},
+		{onStaleAuthenticate, fresh, "", true},
+		{onStaleAuthenticate, stale, "", false},
+		{onStaleAuthenticate, stale, "basic", true},
+		{onStaleDeny, stale, "basic", false},
+	} {
+		a.OnStale = tc.policy
+		req := newGeoRequest(tc.vars)
+		req.Header.Set("Authorization", tc.token)
+		if _, authed, _ := a.Authenticate(httptest.NewRecorder(), req); authed != tc.authed {
+			t.Errorf("auth %s, stale %v, token %q: authenticated = %v, want %v",
+				tc.policy, tc.vars["geoip2.stale"], tc.token, authed, tc.authed)
+		}
+	}
+
+	// Stale clients are challenged although they match no rule.
+	c := &GeoIP2Challenge{
+		Secret: "test-secret",
+		Rules:  []*ChallengeRule{{Difficulty: 4, GeoCriteria: GeoCriteria{Anonymous: []string{"hosting_provider"}}}},
+	}
+	if err := c.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err := c.ServeHTTP(rec, newGeoRequest(stale), nextHandler); err != nil || rec.Code != http.StatusNoContent {
+		t.Errorf("challenge serve: status %d, %v", rec.Code, err)
+	}
+	c.OnStale = onStaleChallenge
+	rec = httptest.NewRecorder()
+	if err := c.ServeHTTP(rec, newGeoRequest(stale), nextHandler); err != nil || rec.Code != http.StatusForbidden {
+		t.Errorf("challenge challenge: status %d, %v", rec.Code, err)
+	}
+	c.OnStale = onStaleDeny
+	if err := c.ServeHTTP(httptest.NewRecorder(), newGeoRequest(stale), nextHandler); !isUnavailable(err) {
+		t.Errorf("challenge deny: expected status 503, got %v", err)
+	}
+
+	for name, h := range map[string]caddyhttp.MiddlewareHandler{
+		"rate limit": &GeoIP2RateLimit{OnStale: onStaleDeny},
+		"load shed":  &GeoIP2LoadShed{MaxConcurrent: 10, OnStale: onStaleDeny},
+	} {
+		if err := h.ServeHTTP(httptest.NewRecorder(), newGeoRequest(stale), nextHandler); !isUnavailable(err) {
+			t.Errorf("%s: expected status 503, got %v", name, err)
+		}
+		if err := h.ServeHTTP(httptest.NewRecorder(), newGeoRequest(fresh), nextHandler); err != nil {
+			t.Errorf("%s: fresh databases denied: %v", name, err)
+		}
+	}
+}
+
+func TestStaleCaddyfile(t *testing.T) {
+	challenge := &GeoIP2Challenge{}
+	if err := challenge.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	geoip2_challenge {
+		on_stale challenge
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	auth := &GeoIP2Auth{}
+	if err := auth.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	geoip2_auth {
+		on_stale authenticate
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	limit := &GeoIP2RateLimit{}
+	if err := limit.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	geoip2_rate_limit {
+		on_stale deny
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	shed := &GeoIP2LoadShed{}
+	if err := shed.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	geoip2_load_shed 10 {
+		on_stale deny
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	if challenge.OnStale != onStaleChallenge || auth.OnStale != onStaleAuthenticate ||
+		limit.OnStale != onStaleDeny || shed.OnStale != onStaleDeny {
+		t.Errorf("unexpected on_stale policies: challenge %q, auth %q, rate limit %q, load shed %q",
+			challenge.OnStale, auth.OnStale, limit.OnStale, shed.OnStale)
+	}
+	if err := (&GeoIP2LoadShed{MaxConcurrent: 10, OnStale: onStaleChallenge}).Validate(); err == nil {
+		t.Error("expected the challenge policy to be invalid for geoip2_load_shed")
+	}
+
+	g := &GeoIP2State{}
+	d := caddyfile.NewTestDispenser(`
+	geoip2 {
+		max_age 720h
+		database city {
+			edition_id GeoLite2-City
+			max_age    168h
+		}
+	}`)
+	if err := g.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if g.MaxAge != caddy.Duration(720*time.Hour) || g.Databases[0].MaxAge != caddy.Duration(168*time.Hour) {
+		t.Errorf("unexpected max ages: app %v, database %v", g.MaxAge, g.Databases[0].MaxAge)
+	}
+}
@@ -1,46 +1,38 @@
 package geoip2
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/fs"
 	"net"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
-	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate"
-	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate/database"
-	"github.com/zhangjiayin/caddy-geoip2/replacer"
 	"go.uber.org/zap"
 )
 
 // GeoIP2State holds the configuration used
 // to manage GeoIP database access and updates.
 type GeoIP2State struct {
-	// mutex synchronizes access to dbReaders.
-	mutex     sync.RWMutex
-	dbReaders []replacer.Replacer
-
-	// done and wg are used to exit gracefully
-	// and wait for any update to complete first.
-	done chan struct{}
-	wg   sync.WaitGroup
-
 	// AccountID is your MaxMind account ID. This was formerly known as UserId.
 	AccountID int `json:"accountId,omitempty"`
 	// DatabaseDirectory specifies the directory where database files are stored.
 	// Defaults to DATADIR.
 	DatabaseDirectory string `json:"databaseDirectory,omitempty"`
-	// LicenseKey is your case-sensitive MaxMind license key.
+	// LicenseKey is your case-sensitive MaxMind license key. It may be an
+	// {env.*} or {file.*} placeholder, resolved when the app is provisioned,
+	// which keeps the key out of the JSON configuration. Literal keys in
+	// the Caddyfile are moved to a file when adapting.
 	LicenseKey string `json:"licenseKey,omitempty"`
+	// LicenseKeyFile is a file containing the license key,
+	// which cannot be combined with LicenseKey.
+	LicenseKeyFile string `json:"license_key_file,omitempty"`
 	// LockFile specifies the path to the lock file used to ensure that only one
 	// geoipupdate process runs at a time.
 	// Note: Once created, this lock file is not removed from the filesystem.
@@ -52,11 +44,89 @@ type GeoIP2State struct {
 	// - "GeoLite2-Country,GeoLite2-ASN"
 	// Note: The JSON tag uses "editionID" for backwards compatibility.
 	EditionIDs []string `json:"editionID,omitempty"`
+	// Databases configures databases individually, e.g. with their own
+	// path, update frequency or lookup priority. EditionIDs are shorthand
+	// for required databases stored as <editionID>.mmdb in DatabaseDirectory.
+	Databases []*DatabaseConfig `json:"databases,omitempty"`
 	// UpdateURL specifies the update server URL. Defaults to https://updates.maxmind.com.
 	UpdateURL string `json:"updateUrl,omitempty"`
 	// UpdateFrequency is the frequency in seconds at which the update runs.
-	// Defaults to 0, which means the update runs only on start.
+	// Defaults to 0, which means the update runs only on start, at most once a day.
+	// The schedule is kept in geoip2-update-state.json in DatabaseDirectory,
+	// so restarts only download databases that are missing or due.
 	UpdateFrequency int `json:"updateFrequency,omitempty"`
+	// UpdateSchedule is a cron expression of the update times, e.g.
+	// "0 3 * * 2,5" for MaxMind's Tuesday and Friday releases. It
+	// cannot be combined with UpdateFrequency.
+	UpdateSchedule string `json:"update_schedule,omitempty"`
+	// UpdateSplay delays each scheduled update by a random duration up
+	// to this value, chosen on start, so that a fleet of servers does
+	// not update at the same time.
+	UpdateSplay caddy.Duration `json:"update_splay,omitempty"`
+	// UpdateWindows are maintenance windows. If any are configured,
+	// updates falling outside of them are deferred to the next window.
+	// Missing databases are downloaded right away.
+	UpdateWindows []*UpdateWindow `json:"update_windows,omitempty"`
+	// UpdateTimezone is the IANA time zone of UpdateSchedule and
+	// UpdateWindows, e.g. "UTC". Defaults to the local time zone.
+	UpdateTimezone string `json:"update_timezone,omitempty"`
+	// WaitForDatabases makes Start block until all required databases are loaded,
+	// failing startup if they are not loaded within this duration.
+	// Defaults to 0, which means Start does not wait.
+	WaitForDatabases caddy.Duration `json:"wait_for_databases,omitempty"`
+	// WatchDatabases reloads a database when its file is replaced
+	// by another process, e.g. a geoipupdate cron job.
+	// Changed files are verified before they are loaded.
+	WatchDatabases bool `json:"watch_databases,omitempty"`
+	// WatchDebounce is how long a changed file must stay unchanged
+	// before it is reloaded. Defaults to 2s.
+	WatchDebounce caddy.Duration `json:"watch_debounce,omitempty"`
+	// WatchPollInterval is the interval at which the files are checked
+	// for changes if file system notifications are unavailable.
+	// Defaults to 1m.
+	WatchPollInterval caddy.Duration `json:"watch_poll_interval,omitempty"`
+	// KeepVersions is the number of downloaded versions of each database
+	// kept in <name>-versions next to the database file, named by their
+	// build epoch. Databases can be rolled back to a kept version and
+	// pinned to it through the admin API. Defaults to 0, which keeps none.
+	KeepVersions int `json:"keep_versions,omitempty"`
+	// MaxAge is the default MaxAge of the databases, after which a
+	// loaded database is stale by its build epoch. Stale databases are
+	// logged, reported by metrics and events, and handled by the
+	// on_stale policy of geoip2_vars. Defaults to 0, which never expires.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+	// Cluster shares the databases between the nodes using the storage
+	// configured for Caddy, e.g. a file system, Redis or S3 storage. A
+	// storage lock makes one node check the source of a database and
+	// publish it, and the other nodes take it over from the storage.
+	// Nodes without MaxMind credentials or sources only take databases
+	// over, and should configure an update frequency or schedule.
+	Cluster bool `json:"cluster,omitempty"`
+	// Offline only loads the database files, e.g. from a read-only
+	// directory on a host without a license key. It never creates,
+	// locks, downloads or writes files, and fails provisioning if a
+	// database file is missing or unreadable. It cannot be combined
+	// with Cluster.
+	Offline bool `json:"offline,omitempty"`
+	// UpdateTransport configures the HTTP client of the updates, e.g.
+	// a proxy, additional root CAs or a client certificate.
+	UpdateTransport *UpdateTransport `json:"update_transport,omitempty"`
+
+	// Instances are named sets of databases with their own account,
+	// license key and directory, e.g. for sites licensed differently.
+	// Handlers choose an instance by name and use the databases
+	// configured above if they do not. Instances cannot be nested.
+	Instances map[string]*GeoIP2State `json:"instances,omitempty"`
+
+	// name is the name of the instance, empty for the app itself.
+	name string
+
+	// dbs holds the database readers and the updater, which are
+	// shared by all config loads with the same configuration.
+	// It is nil if the app only configures named instances.
+	dbs      *databases
+	poolKey  string
+	released bool
 }
 
 const (
@@ -84,91 +154,223 @@ func init() {
 func (g *GeoIP2State) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  moduleName,
-		New: func() caddy.Module { return g },
+		New: func() caddy.Module { return new(GeoIP2State) },
 	}
 }
 
 // Start implements caddy.App.
 func (g *GeoIP2State) Start() error {
 	caddy.Log().Named(moduleName).Debug("start")
-	if err := g.ensureDirectories(); err != nil {
+	for name, inst := range g.Instances {
+		if err := inst.Start(); err != nil {
+			return fmt.Errorf("instance %q: %w", name, err)
+		}
+	}
+	if g.dbs == nil {
+		return nil
+	}
+	if err := g.dbs.start(); err != nil {
 		return err
 	}
-	go g.loadGeoIPReaders()
-	go g.runGeoIPUpdate()
+	if g.WaitForDatabases > 0 {
+		return g.dbs.waitForDatabases(time.Duration(g.WaitForDatabases))
+	}
 	return nil
 }
 
-// Stop implements caddy.App.
+// Stop implements caddy.App. The databases stay loaded until Cleanup,
+// so that the next configuration can take them over.
 func (g *GeoIP2State) Stop() error {
 	caddy.Log().Named(moduleName).Debug("stop")
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (g *GeoIP2State) Provision(ctx caddy.Context) error {
+	caddy.Log().Named(moduleName).Debug("provision")
+	if err := registerStaleMetrics(ctx); err != nil {
+		return fmt.Errorf("registering metrics: %w", err)
+	}
+	for name, inst := range g.Instances {
+		inst.name = name
+		if err := inst.Provision(ctx); err != nil {
+			return fmt.Errorf("instance %q: %w", name, err)
+		}
+	}
+	if len(g.Instances) > 0 && len(g.databaseConfigs()) == 0 {
+		return nil
+	}
+	if g.Offline {
+		if err := checkOfflineFiles(g.databaseConfigs()); err != nil {
+			return err
+		}
+	}
 
-	if g.done != nil {
-		close(g.done)
+	// Instances are shared separately, so that changing
+	// one of them does not reload the others.
+	cfg := *g
+	cfg.Instances = nil
+	key, err := json.Marshal(&cfg)
+	if err != nil {
+		return fmt.Errorf("encoding configuration: %w", err)
+	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return err
 	}
-	g.wg.Wait()
+	// Rotated secrets replace the databases on reload,
+	// without the secrets themselves ending up in the key.
+	g.poolKey = g.name + "/" + configHash(key) + "/" + cfg.secretsHash()
 
-	g.mutex.Lock()
-	defer g.mutex.Unlock()
-	caddy.Log().Named(moduleName).Debug("closing geoip database readers")
-	for _, r := range g.dbReaders {
-		r.Close()
+	dbs, loaded, err := databasesPool.LoadOrNew(g.poolKey, func() (caddy.Destructor, error) {
+		if err := cfg.loadSources(ctx); err != nil {
+			return nil, err
+		}
+		return newDatabases(cfg), nil
+	})
+	if err != nil {
+		return err
+	}
+	if loaded {
+		caddy.Log().Named(moduleName).
+			Debug("reusing geoip databases of unchanged configuration", zap.String("instance", g.name))
+	}
+	g.dbs = dbs.(*databases)
+	g.dbs.events.Store(newEventEmitter(ctx))
+	if g.Cluster {
+		// The databases use the storage of the latest configuration,
+		// which stays valid until the next one takes them over.
+		g.dbs.cluster.Store(newCluster(ctx.Storage(), g.name))
 	}
-	g.dbReaders = nil
 	return nil
 }
 
-// Provision implements caddy.Provisioner.
-func (g *GeoIP2State) Provision(_ caddy.Context) error {
-	caddy.Log().Named(moduleName).Debug("provision")
-	return nil
+// Cleanup implements caddy.CleanerUpper. The databases are closed
+// once no configuration uses them anymore.
+func (g *GeoIP2State) Cleanup() error {
+	var errs []error
+	for _, inst := range g.Instances {
+		errs = append(errs, inst.Cleanup())
+	}
+	if g.dbs != nil && !g.released {
+		g.released = true
+		_, err := databasesPool.Delete(g.poolKey)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// instance returns the named instance, or the
+// databases configured at the top level if name is empty.
+func (g *GeoIP2State) instance(name string) (*GeoIP2State, error) {
+	if name == "" {
+		if g.dbs == nil {
+			return nil, errors.New("no databases configured outside of named instances")
+		}
+		return g, nil
+	}
+	inst, ok := g.Instances[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown geoip2 instance %q", name)
+	}
+	return inst, nil
 }
 
 // Validate implements caddy.Validator.
 func (g *GeoIP2State) Validate() error {
 	caddy.Log().Named(moduleName).Debug("validate")
 
-	if g.DatabaseDirectory == "" || len(g.EditionIDs) == 0 {
-		return fmt.Errorf("missing: DatabaseDirectory %q or EditionIDs %+v", g.DatabaseDirectory, g.EditionIDs)
+	for name, inst := range g.Instances {
+		if len(inst.Instances) > 0 {
+			return fmt.Errorf("instance %q: instances cannot be nested", name)
+		}
+		if err := inst.Validate(); err != nil {
+			return fmt.Errorf("instance %q: %w", name, err)
+		}
+	}
+	if g.DatabaseDirectory == "" && len(g.EditionIDs) > 0 {
+		return fmt.Errorf("missing: DatabaseDirectory %q for EditionIDs %+v", g.DatabaseDirectory, g.EditionIDs)
+	}
+	if g.UpdateFrequency != 0 && g.UpdateSchedule != "" {
+		return errors.New("updateFrequency and update_schedule cannot be combined")
+	}
+	if g.LicenseKey != "" && g.LicenseKeyFile != "" {
+		return errors.New("licenseKey and license_key_file cannot be combined")
+	}
+	if g.Offline && g.Cluster {
+		return errors.New("offline and cluster cannot be combined")
+	}
+	resolved := *g
+	if err := resolved.resolveSecrets(); err != nil {
+		return err
+	}
+	if _, err := resolved.UpdateTransport.client(); err != nil {
+		return fmt.Errorf("update_transport: %w", err)
+	}
+	configs := g.databaseConfigs()
+	if len(g.Instances) > 0 && len(configs) == 0 {
+		return nil
+	}
+	if err := validateDatabases(configs); err != nil {
+		return err
+	}
+	for _, db := range configs {
+		if _, err := g.updateSchedule(db, 0); err != nil {
+			return fmt.Errorf("database %q: %w", db.Name, err)
+		}
 	}
 	return nil
 }
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	geoip2 {
+//	    <option> <value>
+//	    instance <name> {
+//	        <option> <value>
+//	    }
+//	}
 func (g *GeoIP2State) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		var value string
 		key := d.Val()
+		if key == "update_transport" {
+			g.UpdateTransport = new(UpdateTransport)
+			if err := g.UpdateTransport.unmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			continue
+		}
 		if !d.Args(&value) {
 			continue
 		}
-		switch key {
-		case "accountId":
-			accountID, err := strconv.Atoi(value)
-			if err != nil {
-				return fmt.Errorf("accountID is not an integer: %w", err)
+		if key != "instance" {
+			if err := g.unmarshalOption(d, key, value); err != nil {
+				return err
 			}
-			g.AccountID = accountID
-		case "databaseDirectory":
-			g.DatabaseDirectory = value
-		case "licenseKey":
-			g.LicenseKey = value
-		case "lockFile":
-			g.LockFile = value
-		case "editionID":
-			editionIDs := strings.Split(value, ",")
-			for _, e := range editionIDs {
-				g.EditionIDs = append(g.EditionIDs, strings.TrimSpace(e))
+			continue
+		}
+		inst := &GeoIP2State{}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			var value string
+			key := d.Val()
+			if key == "update_transport" {
+				inst.UpdateTransport = new(UpdateTransport)
+				if err := inst.UpdateTransport.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+				continue
+			}
+			if !d.Args(&value) {
+				continue
 			}
-		case "updateUrl":
-			g.UpdateURL = value
-		case "updateFrequency":
-			updateFrequency, err := strconv.Atoi(value)
-			if err != nil {
-				return fmt.Errorf("updateFrequency is not an integer: %w", err)
+			if err := inst.unmarshalOption(d, key, value); err != nil {
+				return err
 			}
-			g.UpdateFrequency = updateFrequency
 		}
+		if g.Instances == nil {
+			g.Instances = make(map[string]*GeoIP2State)
+		}
+		g.Instances[value] = inst
 	}
 
 	if g.UpdateURL == "" {
@@ -180,141 +382,193 @@ func (g *GeoIP2State) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	if g.LockFile == "" {
 		g.LockFile = "/tmp/geoip2.lock"
 	}
-	if len(g.EditionIDs) == 0 {
+	if len(g.EditionIDs) == 0 && len(g.Databases) == 0 && len(g.Instances) == 0 {
 		g.EditionIDs = []string{"GeoLite2-City"}
 	}
-	caddy.Log().Named(moduleName).Debug("configuration loaded", zap.Any("config", g))
-	return nil
-}
-
-func (g *GeoIP2State) lookup(repl *caddy.Replacer, clientIP net.IP) {
-	g.mutex.RLock()
-	defer g.mutex.RUnlock()
-	for _, r := range g.dbReaders {
-		r.Lookup(repl, clientIP)
+	// Instances keep their files apart from each other by default.
+	for name, inst := range g.Instances {
+		if inst.UpdateURL == "" {
+			inst.UpdateURL = g.UpdateURL
+		}
+		if inst.DatabaseDirectory == "" {
+			inst.DatabaseDirectory = filepath.Join(g.DatabaseDirectory, name)
+		}
+		if inst.LockFile == "" {
+			inst.LockFile = filepath.Join(inst.DatabaseDirectory, "geoip2.lock")
+		}
+		if len(inst.EditionIDs) == 0 && len(inst.Databases) == 0 {
+			inst.EditionIDs = []string{"GeoLite2-City"}
+		}
+		if inst.WaitForDatabases == 0 {
+			inst.WaitForDatabases = g.WaitForDatabases
+		}
+		if inst.MaxAge == 0 {
+			inst.MaxAge = g.MaxAge
+		}
+		if inst.UpdateTransport == nil {
+			inst.UpdateTransport = g.UpdateTransport
+		}
+		if g.Offline {
+			inst.Offline = true
+		}
 	}
+	caddy.Log().Named(moduleName).Debug("configuration loaded", zap.Any("config", g.redacted()))
+	return nil
 }
 
-func (g *GeoIP2State) loadGeoIPReaders() {
-	caddy.Log().Named(moduleName).Debug("load geoip readers")
-	var dbReaders []replacer.Replacer
-	for _, editionID := range g.EditionIDs {
-		filePath := filepath.Join(g.DatabaseDirectory, editionID+".mmdb")
-		if _, err := os.Stat(filePath); errors.Is(err, fs.ErrNotExist) {
-			caddy.Log().Named(moduleName).
-				Error("missing geoip database file", zap.String("editionID", editionID))
-			continue
+// unmarshalOption parses the option key with its first value.
+func (g *GeoIP2State) unmarshalOption(d *caddyfile.Dispenser, key, value string) error {
+	switch key {
+	case "database":
+		db := &DatabaseConfig{Name: value}
+		if err := db.unmarshalCaddyfile(d); err != nil {
+			return err
 		}
-		dbReader, err := replacer.New(filePath)
+		g.Databases = append(g.Databases, db)
+	case "accountId":
+		accountID, err := strconv.Atoi(value)
 		if err != nil {
-			caddy.Log().Named(moduleName).
-				Error("initializing geoip database reader", zap.String("editionID", editionID), zap.Error(err))
-			continue
+			return fmt.Errorf("accountID is not an integer: %w", err)
 		}
-		caddy.Log().Named(moduleName).
-			Info("initialized geoip database reader", zap.String("editionID", editionID))
-		dbReaders = append(dbReaders, dbReader)
-	}
-
-	g.mutex.Lock()
-	defer g.mutex.Unlock()
-	g.dbReaders = dbReaders
-}
-
-func (g *GeoIP2State) runGeoIPUpdate() {
-	if g.AccountID <= 0 || g.LicenseKey == "" {
-		return
-	}
-	g.done = make(chan struct{}, 1)
-	g.wg.Add(1)
-	defer g.wg.Done()
-
-	config := geoipupdate.Config{
-		AccountID:         g.AccountID,
-		DatabaseDirectory: g.DatabaseDirectory,
-		LicenseKey:        g.LicenseKey,
-		LockFile:          g.LockFile,
-		EditionIDs:        g.EditionIDs,
-		URL:               g.UpdateURL,
-	}
-	// We currently have to use an older version of the geoipupdate
-	// library because the newer client does not provide a convenient way
-	// to write database files to disk. We should keep an eye on future
-	// updates to that package to determine when an upgrade becomes feasible.
-	client := geoipupdate.NewClient(&config)
-	dbReader := database.NewHTTPDatabaseReader(client, &config)
-
-	update := func() {
-		caddy.Log().Named(moduleName).Debug("update geoip databases")
-		for _, editionID := range g.EditionIDs {
-			filePath := filepath.Join(g.DatabaseDirectory, editionID+".mmdb")
-			dbWriter, err := database.NewLocalFileDatabaseWriter(
-				filePath,
-				config.LockFile,
-				config.Verbose,
-			)
-			if err != nil {
-				caddy.Log().Named(moduleName).
-					Error("creating database writer", zap.String("editionID", editionID), zap.Error(err))
-				continue
+		g.AccountID = accountID
+	case "databaseDirectory":
+		g.DatabaseDirectory = value
+	case "licenseKey":
+		licenseKey, err := caddyfileSecret(d, key, value)
+		if err != nil {
+			return err
+		}
+		g.LicenseKey = licenseKey
+	case "license_key_file":
+		g.LicenseKeyFile = value
+	case "lockFile":
+		g.LockFile = value
+	case "editionID":
+		editionIDs := strings.Split(value, ",")
+		for _, e := range editionIDs {
+			g.EditionIDs = append(g.EditionIDs, strings.TrimSpace(e))
+		}
+	case "updateUrl":
+		g.UpdateURL = value
+	case "updateFrequency":
+		// Plain integers are seconds.
+		updateFrequency, err := strconv.Atoi(value)
+		if err != nil {
+			frequency, derr := caddy.ParseDuration(value)
+			if derr != nil {
+				return fmt.Errorf("updateFrequency is neither seconds nor a duration: %w", derr)
 			}
-			if err := dbReader.Get(dbWriter, editionID); err != nil {
-				caddy.Log().Named(moduleName).
-					Error("downloading new database file", zap.String("editionID", editionID), zap.Error(err))
-				continue
+			// Zero disables the periodic updates, so shorter
+			// durations must not be truncated to it.
+			if frequency < time.Second {
+				return d.Errf("updateFrequency must be at least one second: %s", value)
 			}
-			caddy.Log().Named(moduleName).
-				Info("updated database file", zap.String("editionID", editionID))
+			updateFrequency = int(frequency / time.Second)
 		}
-		g.loadGeoIPReaders()
-	}
-
-	// run the update at least once to download database files
-	// the first time.
-	update()
-
-	if g.UpdateFrequency != 0 {
-		tick := time.NewTicker(time.Second * time.Duration(g.UpdateFrequency)).C
-		for {
-			select {
-			case <-tick:
-				update()
-			case <-g.done:
-				return
-			}
+		g.UpdateFrequency = updateFrequency
+	case "update_schedule":
+		// Cron expressions may be given quoted or as separate arguments.
+		g.UpdateSchedule = strings.Join(append([]string{value}, d.RemainingArgs()...), " ")
+	case "update_splay":
+		splay, err := caddy.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("update_splay is not a duration: %w", err)
+		}
+		g.UpdateSplay = caddy.Duration(splay)
+	case "update_window":
+		start, end, ok := strings.Cut(value, "-")
+		if !ok {
+			return fmt.Errorf("update_window %q is not of the form <start>-<end>", value)
 		}
+		window := &UpdateWindow{Start: start, End: end}
+		if d.NextArg() {
+			window.Days = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		g.UpdateWindows = append(g.UpdateWindows, window)
+	case "update_timezone":
+		g.UpdateTimezone = value
+	case "wait_for_databases":
+		timeout, err := caddy.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("wait_for_databases is not a duration: %w", err)
+		}
+		g.WaitForDatabases = caddy.Duration(timeout)
+	case "watch_databases":
+		watch, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("watch_databases is not a boolean: %w", err)
+		}
+		g.WatchDatabases = watch
+	case "watch_debounce":
+		debounce, err := caddy.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("watch_debounce is not a duration: %w", err)
+		}
+		g.WatchDebounce = caddy.Duration(debounce)
+	case "watch_poll_interval":
+		interval, err := caddy.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("watch_poll_interval is not a duration: %w", err)
+		}
+		g.WatchPollInterval = caddy.Duration(interval)
+	case "keep_versions":
+		keep, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("keep_versions is not an integer: %w", err)
+		}
+		g.KeepVersions = keep
+	case "max_age":
+		maxAge, err := caddy.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("max_age is not a duration: %w", err)
+		}
+		g.MaxAge = caddy.Duration(maxAge)
+	case "cluster":
+		cluster, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("cluster is not a boolean: %w", err)
+		}
+		g.Cluster = cluster
+	case "offline":
+		offline, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("offline is not a boolean: %w", err)
+		}
+		g.Offline = offline
 	}
+	return nil
 }
 
-func (g *GeoIP2State) hasDBReaders() bool {
-	g.mutex.Lock()
-	defer g.mutex.Unlock()
-	return g.dbReaders != nil
-}
-
-func (g *GeoIP2State) ensureDirectories() error {
-	// Create the database directory if needed
-	if err := mkdirIfMissing(g.DatabaseDirectory); err != nil {
-		return fmt.Errorf("ensuring database directory %q: %w", g.DatabaseDirectory, err)
+func (g *GeoIP2State) lookup(repl *caddy.Replacer, clientIP net.IP) {
+	if g.dbs != nil {
+		g.dbs.lookup(repl, clientIP)
 	}
+}
 
-	// Create the lock file directory if needed
-	lockFileDir := filepath.Dir(g.LockFile)
-
-	if err := mkdirIfMissing(lockFileDir); err != nil {
-		return fmt.Errorf("ensuring lock file directory %q: %w", lockFileDir, err)
+// record returns the raw database records for clientIP merged
+// across all loaded databases.
+func (g *GeoIP2State) record(clientIP net.IP) (map[string]any, error) {
+	if g.dbs == nil {
+		return map[string]any{}, nil
 	}
+	return g.dbs.record(clientIP)
+}
 
-	return nil
+func (g *GeoIP2State) hasDBReaders() bool {
+	return g.dbs != nil && g.dbs.hasDBReaders()
 }
 
-func mkdirIfMissing(path string) error {
-	if path == "" {
-		// If the folder path is empty, we can't create it
-		return nil
-	}
+// isReady reports whether all required databases have been loaded.
+func (g *GeoIP2State) isReady() bool {
+	return g.dbs != nil && g.dbs.isReady()
+}
 
-	return os.MkdirAll(path, 0o700)
+// isStale reports whether a loaded database is older than its max age.
+func (g *GeoIP2State) isStale() bool {
+	return g.dbs != nil && g.dbs.isStale()
 }
 
 var (
@@ -323,4 +577,5 @@ var (
 	_ caddy.Provisioner     = (*GeoIP2State)(nil)
 	_ caddy.Validator       = (*GeoIP2State)(nil)
 	_ caddy.App             = (*GeoIP2State)(nil)
+	_ caddy.CleanerUpper    = (*GeoIP2State)(nil)
 )
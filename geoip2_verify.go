@@ -0,0 +1,375 @@
+package geoip2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"golang.org/x/crypto/blake2b"
+)
+
+// maxVerifyFileSize limits the size of fetched manifests and signatures.
+const maxVerifyFileSize = 1 << 20
+
+// VerifyConfig configures the verification of downloaded databases
+// against pinned digests, a SHA-256 manifest or a detached signature.
+// All configured checks must pass before a download replaces the
+// database file; failed downloads are rejected like failed canaries.
+type VerifyConfig struct {
+	// SHA256 are the hex encoded SHA-256 digests of the accepted
+	// database files.
+	SHA256 []string `json:"sha256,omitempty"`
+	// Manifest is the URL or path of a manifest of SHA-256 digests in
+	// the format of sha256sum, which must list the database file.
+	Manifest string `json:"manifest,omitempty"`
+	// ManifestName is the file name the manifest lists the database
+	// under. Defaults to the base name of the database path.
+	ManifestName string `json:"manifest_name,omitempty"`
+	// Signature is the URL or path of a detached signature. It signs
+	// the manifest if one is configured, and the database file otherwise.
+	Signature string `json:"signature,omitempty"`
+	// MinisignKey is the minisign public key that made Signature,
+	// i.e. the base64 encoded second line of its public key file.
+	MinisignKey string `json:"minisign_key,omitempty"`
+	// PublicKeyFile is a PEM file of the ECDSA or Ed25519 public key
+	// that made Signature, as created by "cosign generate-key-pair".
+	// Its signatures are base64 encoded as by "cosign sign-blob".
+	PublicKeyFile string `json:"public_key_file,omitempty"`
+}
+
+// validate checks the configuration of c.
+func (c *VerifyConfig) validate() error {
+	if c.Manifest == "" && c.Signature == "" && len(c.SHA256) == 0 {
+		return errors.New("verify: no sha256, manifest or signature configured")
+	}
+	for _, sum := range c.SHA256 {
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("verify: invalid sha256 digest %q", sum)
+		}
+	}
+	switch {
+	case c.MinisignKey != "" && c.PublicKeyFile != "":
+		return errors.New("verify: minisign_key and public_key cannot be combined")
+	case c.Signature != "" && c.MinisignKey == "" && c.PublicKeyFile == "":
+		return errors.New("verify: a signature requires minisign_key or public_key")
+	case c.Signature == "" && (c.MinisignKey != "" || c.PublicKeyFile != ""):
+		return errors.New("verify: a public key requires a signature")
+	}
+	if c.MinisignKey != "" {
+		if _, err := parseMinisignKey(c.MinisignKey); err != nil {
+			return fmt.Errorf("verify: %w", err)
+		}
+	}
+	if c.PublicKeyFile != "" {
+		if _, err := loadPublicKey(c.PublicKeyFile); err != nil {
+			return fmt.Errorf("verify: %w", err)
+		}
+	}
+	return nil
+}
+
+// verify checks the database file at path of db, fetching the
+// manifest and signature with client. A nil c accepts every file.
+func (c *VerifyConfig) verify(ctx context.Context, client *http.Client, db *DatabaseConfig, path string) error {
+	if c == nil {
+		return nil
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if len(c.SHA256) > 0 && !slices.ContainsFunc(c.SHA256, func(s string) bool { return strings.EqualFold(s, sum) }) {
+		return fmt.Errorf("sha256 %s is not pinned", sum)
+	}
+
+	var manifest []byte
+	if c.Manifest != "" {
+		if manifest, err = fetchVerifyFile(ctx, client, c.Manifest); err != nil {
+			return fmt.Errorf("fetching manifest: %w", err)
+		}
+	}
+	if c.Signature != "" {
+		signature, err := fetchVerifyFile(ctx, client, c.Signature)
+		if err != nil {
+			return fmt.Errorf("fetching signature: %w", err)
+		}
+		var signed io.Reader
+		if manifest != nil {
+			signed = bytes.NewReader(manifest)
+		} else {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			signed = f
+		}
+		if err := c.verifySignature(signed, signature); err != nil {
+			return err
+		}
+	}
+	if manifest != nil {
+		name := c.ManifestName
+		if name == "" {
+			name = filepath.Base(db.Path)
+		}
+		listed, err := manifestSHA256(manifest, name)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(listed, sum) {
+			return fmt.Errorf("sha256 %s does not match the manifest (%s)", sum, listed)
+		}
+	}
+	return nil
+}
+
+// verifySignature verifies signature of the data read from signed.
+func (c *VerifyConfig) verifySignature(signed io.Reader, signature []byte) error {
+	if c.MinisignKey != "" {
+		key, err := parseMinisignKey(c.MinisignKey)
+		if err != nil {
+			return err
+		}
+		return key.verify(signed, signature)
+	}
+	key, err := loadPublicKey(c.PublicKeyFile)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		// Accept raw signatures as well.
+		sig = signature
+	}
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		h := sha256.New()
+		if _, err := io.Copy(h, signed); err != nil {
+			return err
+		}
+		if !ecdsa.VerifyASN1(key, h.Sum(nil), sig) {
+			return errors.New("invalid signature")
+		}
+	case ed25519.PublicKey:
+		data, err := io.ReadAll(signed)
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(key, data, sig) {
+			return errors.New("invalid signature")
+		}
+	}
+	return nil
+}
+
+// minisignKey is a minisign Ed25519 public key.
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignKey parses the base64 encoded minisign public key s.
+func parseMinisignKey(s string) (*minisignKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != 2+8+ed25519.PublicKeySize || string(b[:2]) != "Ed" {
+		return nil, errors.New("invalid minisign public key")
+	}
+	k := &minisignKey{key: ed25519.PublicKey(b[10:])}
+	copy(k.id[:], b[2:10])
+	return k, nil
+}
+
+// verify verifies the minisign signature file signature of the data
+// read from signed, including the signature of its trusted comment.
+// Both legacy and prehashed signatures are supported.
+func (k *minisignKey) verify(signed io.Reader, signature []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) < 4 {
+		return errors.New("malformed minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return errors.New("malformed minisign signature")
+	}
+	trusted, ok := strings.CutPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if !ok {
+		return errors.New("minisign signature without trusted comment")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return errors.New("malformed minisign signature")
+	}
+	if !bytes.Equal(sig[2:10], k.id[:]) {
+		return fmt.Errorf("minisign signature by key %X, want %X", sig[2:10], k.id)
+	}
+
+	var message []byte
+	switch string(sig[:2]) {
+	case "Ed":
+		if message, err = io.ReadAll(signed); err != nil {
+			return err
+		}
+	case "ED":
+		h, _ := blake2b.New512(nil)
+		if _, err := io.Copy(h, signed); err != nil {
+			return err
+		}
+		message = h.Sum(nil)
+	default:
+		return fmt.Errorf("unsupported minisign signature algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(k.key, message, sig[10:]) {
+		return errors.New("invalid signature")
+	}
+	if !ed25519.Verify(k.key, append(slices.Clone(sig[10:]), trusted...), global) {
+		return errors.New("invalid signature of the trusted comment")
+	}
+	return nil
+}
+
+// loadPublicKey reads the PEM encoded ECDSA or Ed25519 public key in file.
+func loadPublicKey(file string) (any, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in public key file %s", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", key)
+}
+
+// manifestSHA256 returns the digest manifest lists for name.
+func manifestSHA256(manifest []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for scanner.Scan() {
+		sum, file, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !ok {
+			continue
+		}
+		// Binary mode entries mark the name with an asterisk.
+		file = strings.TrimPrefix(strings.TrimSpace(file), "*")
+		if file == name || filepath.Base(file) == name {
+			return sum, nil
+		}
+	}
+	return "", fmt.Errorf("manifest does not list %s", name)
+}
+
+// fetchVerifyFile returns the contents of the manifest or signature at
+// location, which is an HTTP(S) URL or a local path.
+func fetchVerifyFile(ctx context.Context, client *http.Client, location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(io.LimitReader(f, maxVerifyFileSize))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxVerifyFileSize))
+}
+
+// fileSHA256 returns the hex encoded SHA-256 digest of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// unmarshalCaddyfile parses a verify block.
+//
+//	verify {
+//	    sha256       <digest>...
+//	    manifest     <url or file> [<name>]
+//	    signature    <url or file>
+//	    minisign_key <public key>
+//	    public_key   <pem file>
+//	}
+func (c *VerifyConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		switch key {
+		case "sha256":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			c.SHA256 = append(c.SHA256, args...)
+			continue
+		case "manifest":
+			if !d.Args(&c.Manifest) {
+				return d.ArgErr()
+			}
+			d.Args(&c.ManifestName)
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			continue
+		}
+
+		var value string
+		if !d.Args(&value) || d.NextArg() {
+			return d.ArgErr()
+		}
+		switch key {
+		case "signature":
+			c.Signature = value
+		case "minisign_key":
+			c.MinisignKey = value
+		case "public_key":
+			c.PublicKeyFile = value
+		default:
+			return d.Errf("unrecognized verify subdirective %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package geoip2
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignSign returns the minisign public key of priv and the
+// signature file of data, which is prehashed unless legacy is set.
+func minisignSign(priv ed25519.PrivateKey, id [8]byte, data []byte, legacy bool) (key string, signature []byte) {
+	pub := priv.Public().(ed25519.PublicKey)
+	key = base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id[:]...), pub...))
+
+	alg, message := "ED", data
+	if legacy {
+		alg = "Ed"
+	} else {
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	}
+	sig := ed25519.Sign(priv, message)
+	trusted := "timestamp:1700000000\tfile:GeoIP2-Country-Test.mmdb"
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), trusted...))
+	signature = fmt.Appendf(nil, "untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte(alg), id[:]...), sig...)),
+		trusted, base64.StdEncoding.EncodeToString(global))
+	return key, signature
+}
+
+func TestMinisignVerify(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	data := []byte("database")
+
+	for _, legacy := range []bool{false, true} {
+		key, signature := minisignSign(priv, id, data, legacy)
+		k, err := parseMinisignKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := k.verify(bytes.NewReader(data), signature); err != nil {
+			t.Errorf("legacy %t: %v", legacy, err)
+		}
+		if err := k.verify(bytes.NewReader([]byte("tampered")), signature); err == nil {
+			t.Errorf("legacy %t: signature of tampered data accepted", legacy)
+		}
+		tampered := bytes.Replace(signature, []byte("timestamp:1700000000"), []byte("timestamp:1800000000"), 1)
+		if err := k.verify(bytes.NewReader(data), tampered); err == nil {
+			t.Errorf("legacy %t: tampered trusted comment accepted", legacy)
+		}
+	}
+
+	// Signatures by another key are rejected by their key ID.
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := minisignSign(priv, id, data, false)
+	_, signature := minisignSign(other, [8]byte{9}, data, false)
+	k, _ := parseMinisignKey(key)
+	if err := k.verify(bytes.NewReader(data), signature); err == nil {
+		t.Error("signature by another key accepted")
+	}
+}
+
+func TestPublicKeySignature(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("database")
+	writeKey := func(name string, pub any) string {
+		t.Helper()
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		key  string
+		sig  []byte
+	}{
+		{"ecdsa", writeKey("cosign.pub", &ecKey.PublicKey), ecSig},
+		{"ed25519", writeKey("ed25519.pub", edPub), ed25519.Sign(edPriv, data)},
+	} {
+		c := &VerifyConfig{Signature: "unused", PublicKeyFile: tt.key}
+		if err := c.validate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		signature := []byte(base64.StdEncoding.EncodeToString(tt.sig) + "\n")
+		if err := c.verifySignature(bytes.NewReader(data), signature); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if err := c.verifySignature(bytes.NewReader([]byte("tampered")), signature); err == nil {
+			t.Errorf("%s: signature of tampered data accepted", tt.name)
+		}
+	}
+}
+
+func TestVerifyConfig(t *testing.T) {
+	for _, c := range []*VerifyConfig{
+		{},
+		{SHA256: []string{"abc"}},
+		{Signature: "db.sig"},
+		{MinisignKey: "RWQ"},
+		{Signature: "db.sig", MinisignKey: "invalid"},
+		{Signature: "db.sig", MinisignKey: "RWQ", PublicKeyFile: "cosign.pub"},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("invalid verify config accepted: %+v", c)
+		}
+	}
+
+	d := caddyfile.NewTestDispenser(`{
+		sha256 aa bb
+		manifest https://mirror.example.com/SHA256SUMS City.mmdb
+		signature https://mirror.example.com/SHA256SUMS.minisig
+		minisign_key RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3
+	}`)
+	var c VerifyConfig
+	if err := c.unmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.SHA256) != 2 || c.Manifest != "https://mirror.example.com/SHA256SUMS" || c.ManifestName != "City.mmdb" ||
+		c.Signature != "https://mirror.example.com/SHA256SUMS.minisig" || c.MinisignKey == "" {
+		t.Errorf("unexpected verify config: %+v", c)
+	}
+}
+
+func TestVerifyRejectsDownload(t *testing.T) {
+	var requests atomic.Int64
+	srv := newUpdateServer(t, &requests)
+	sum := sha256.Sum256(readTestDatabase(t, "GeoIP2-Country-Test"))
+	digest := hex.EncodeToString(sum[:])
+
+	update := func(dir string, verify *VerifyConfig) {
+		d := newDatabases(GeoIP2State{
+			AccountID:         1,
+			LicenseKey:        "key",
+			DatabaseDirectory: dir,
+			LockFile:          filepath.Join(dir, "geoip2.lock"),
+			Databases:         []*DatabaseConfig{{EditionID: "GeoIP2-Country-Test", Verify: verify}},
+			UpdateURL:         srv.URL,
+		})
+		d.loadGeoIPReaders()
+		d.wg.Add(1)
+		d.runGeoIPUpdate()
+		d.Destruct()
+	}
+
+	// A download that fails verification is kept aside,
+	// and the previous version keeps serving.
+	dir := t.TempDir()
+	path := filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	previous := readTestDatabase(t, "GeoIP2-City-Test")
+	replaceFile(t, path, previous)
+	update(dir, &VerifyConfig{SHA256: []string{hex.EncodeToString(make([]byte, sha256.Size))}})
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, previous) {
+		t.Error("previous database file replaced by an unverified download")
+	}
+	if _, err := os.Stat(path + rejectedSuffix); err != nil {
+		t.Errorf("rejected database not kept: %v", err)
+	}
+
+	// A download listed in a signed manifest is promoted.
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = t.TempDir()
+	path = filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	manifest := []byte(digest + "  GeoIP2-Country-Test.mmdb\n")
+	key, signature := minisignSign(priv, [8]byte{1}, manifest, false)
+	if err := os.WriteFile(filepath.Join(dir, "SHA256SUMS"), manifest, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "SHA256SUMS.minisig"), signature, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	verify := &VerifyConfig{
+		Manifest:    filepath.Join(dir, "SHA256SUMS"),
+		Signature:   filepath.Join(dir, "SHA256SUMS.minisig"),
+		MinisignKey: key,
+	}
+	update(dir, verify)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("verified database not promoted: %v", err)
+	}
+
+	// A manifest with an invalid signature is not trusted.
+	tampered := []byte(hex.EncodeToString(make([]byte, sha256.Size)) + "  other.mmdb\n" + string(manifest))
+	if err := os.WriteFile(filepath.Join(dir, "SHA256SUMS"), tampered, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify.verify(context.Background(), nil, &DatabaseConfig{Path: path}, path); err == nil {
+		t.Error("tampered manifest accepted")
+	}
+}
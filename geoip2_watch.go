@@ -0,0 +1,229 @@
+package geoip2
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWatchDebounce     = 2 * time.Second
+	defaultWatchPollInterval = time.Minute
+)
+
+// fileStamp identifies the version of a database file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newFileStamp(info fs.FileInfo) fileStamp {
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// newFileWatcher returns a watcher of the directories of the database
+// files, or nil if file system notifications are unavailable.
+func (d *databases) newFileWatcher() *fsnotify.Watcher {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		dirs := make(map[string]bool)
+		for _, db := range d.configs {
+			dir := filepath.Dir(db.Path)
+			if dirs[dir] {
+				continue
+			}
+			dirs[dir] = true
+			if err = watcher.Add(dir); err != nil {
+				watcher.Close()
+				break
+			}
+		}
+	}
+	if err != nil {
+		caddy.Log().Named(moduleName).
+			Warn("file system notifications unavailable, polling database files", zap.Error(err))
+		return nil
+	}
+	return watcher
+}
+
+// watchDatabases reloads databases whose files
+// are replaced by another process. It uses the events of watcher, or
+// polls the files if watcher is nil. Changes are debounced, so an
+// database is reloaded once its file has not changed for a while.
+func (d *databases) watchDatabases(watcher *fsnotify.Watcher) {
+	defer d.wg.Done()
+
+	changed := make(chan string)
+	d.wg.Add(1)
+	if watcher == nil {
+		go d.pollDatabaseFiles(changed)
+	} else {
+		defer watcher.Close()
+		go d.forwardFileEvents(watcher, changed)
+	}
+
+	debounce := time.Duration(d.cfg.WatchDebounce)
+	if debounce <= 0 {
+		debounce = defaultWatchDebounce
+	}
+	timers := make(map[string]*time.Timer)
+	fire := make(chan string)
+	// rejected holds the files that failed validation,
+	// so that they are not validated over and over again.
+	rejected := make(map[string]fileStamp)
+	for {
+		select {
+		case name := <-changed:
+			if timer, ok := timers[name]; ok {
+				timer.Reset(debounce)
+				continue
+			}
+			timers[name] = time.AfterFunc(debounce, func() {
+				select {
+				case fire <- name:
+				case <-d.done:
+				}
+			})
+		case name := <-fire:
+			delete(timers, name)
+			d.reloadChangedDatabase(d.databaseConfig(name), rejected)
+		case <-d.done:
+			for _, timer := range timers {
+				timer.Stop()
+			}
+			return
+		}
+	}
+}
+
+// forwardFileEvents sends the names of databases with changed files to changed.
+func (d *databases) forwardFileEvents(watcher *fsnotify.Watcher, changed chan<- string) {
+	defer d.wg.Done()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// A removed file leaves the loaded database in place.
+			if event.Has(fsnotify.Remove) {
+				continue
+			}
+			db := d.databaseOfFile(event.Name)
+			if db == nil {
+				continue
+			}
+			select {
+			case changed <- db.Name:
+			case <-d.done:
+				return
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			caddy.Log().Named(moduleName).Error("watching database directory", zap.Error(err))
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// pollDatabaseFiles sends the names of databases whose files
+// differ from the loaded ones to changed.
+func (d *databases) pollDatabaseFiles(changed chan<- string) {
+	defer d.wg.Done()
+
+	interval := time.Duration(d.cfg.WatchPollInterval)
+	if interval <= 0 {
+		interval = defaultWatchPollInterval
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			for _, db := range d.configs {
+				info, err := os.Stat(db.Path)
+				if err != nil {
+					continue
+				}
+				if r := d.readers.Load().reader(db.Name); r != nil && r.stamp == newFileStamp(info) {
+					continue
+				}
+				select {
+				case changed <- db.Name:
+				case <-d.done:
+					return
+				}
+			}
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// reloadChangedDatabase validates the file of db and replaces the
+// loaded database with it. Rejected files are logged and recorded in
+// rejected, and the loaded database is kept.
+func (d *databases) reloadChangedDatabase(db *DatabaseConfig, rejected map[string]fileStamp) {
+	info, err := os.Stat(db.Path)
+	if err != nil {
+		return
+	}
+	stamp := newFileStamp(info)
+	s := d.acquireReaders()
+	if s != nil {
+		defer s.release()
+	}
+	previous := s.reader(db.Name)
+	if previous != nil && previous.stamp == stamp || rejected[db.Name] == stamp {
+		return
+	}
+
+	reader, err := d.openDatabase(db, info, previous)
+	if err != nil {
+		rejected[db.Name] = stamp
+		caddy.Log().Named(moduleName).Error("rejected geoip database file, keeping previous reader",
+			zap.String("database", db.Name), zap.String("path", db.Path), zap.Error(err))
+		return
+	}
+	delete(rejected, db.Name)
+
+	meta := reader.Metadata()
+	d.replaceReader(reader)
+	caddy.Log().Named(moduleName).
+		Info("reloaded changed database file", zap.String("database", db.Name))
+	d.emit(eventDatabaseLoaded, db, map[string]any{
+		"build_epoch":   meta.BuildEpoch,
+		"database_type": meta.DatabaseType,
+	})
+	d.checkStaleness(time.Now())
+}
+
+// databaseOfFile returns the database stored in the file at path, if any.
+func (d *databases) databaseOfFile(path string) *DatabaseConfig {
+	path = filepath.Clean(path)
+	for _, db := range d.configs {
+		if filepath.Clean(db.Path) == path {
+			return db
+		}
+	}
+	return nil
+}
+
+// databaseConfig returns the configuration of the named database.
+func (d *databases) databaseConfig(name string) *DatabaseConfig {
+	for _, db := range d.configs {
+		if db.Name == name {
+			return db
+		}
+	}
+	return nil
+}
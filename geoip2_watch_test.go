@@ -0,0 +1,140 @@
+package geoip2
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// replaceFile atomically replaces path with data.
+func replaceFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestDatabase(t *testing.T, editionID string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("replacer/test-data/test-data", editionID+".mmdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestWatchReloadsReplacedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	replaceFile(t, path, readTestDatabase(t, "GeoIP2-Country-Test"))
+
+	d := newDatabases(GeoIP2State{
+		DatabaseDirectory: dir,
+		EditionIDs:        []string{"GeoIP2-Country-Test"},
+		WatchDatabases:    true,
+		WatchDebounce:     caddy.Duration(20 * time.Millisecond),
+	})
+	if err := d.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Destruct() })
+	if err := d.waitForDatabases(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	loaded := d.readers.Load().readers[0]
+
+	replaceFile(t, path, readTestDatabase(t, "GeoIP2-Country-Test"))
+	touchFile(t, path)
+	deadline := time.Now().Add(5 * time.Second)
+	for d.readers.Load().readers[0] == loaded {
+		if time.Now().After(deadline) {
+			t.Fatal("replaced database file was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	loaded = d.readers.Load().readers[0]
+
+	// A corrupt file is rejected and the loaded database is kept.
+	corrupt := readTestDatabase(t, "GeoIP2-Country-Test")
+	for i := range 256 {
+		corrupt[i] = 0xff
+	}
+	replaceFile(t, path, corrupt)
+	time.Sleep(300 * time.Millisecond)
+	if d.readers.Load().readers[0] != loaded {
+		t.Fatal("corrupt database file was loaded")
+	}
+	if _, err := d.record(net.ParseIP("81.2.69.160")); err != nil {
+		t.Fatalf("looking up after rejecting a corrupt file: %v", err)
+	}
+}
+
+func TestWatchPolling(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	replaceFile(t, path, readTestDatabase(t, "GeoIP2-Country-Test"))
+
+	d := newDatabases(GeoIP2State{
+		DatabaseDirectory: dir,
+		EditionIDs:        []string{"GeoIP2-Country-Test"},
+		WatchPollInterval: caddy.Duration(10 * time.Millisecond),
+	})
+	d.loadGeoIPReaders()
+	changed := make(chan string)
+	d.wg.Add(1)
+	go d.pollDatabaseFiles(changed)
+	t.Cleanup(func() { d.Destruct() })
+
+	select {
+	case editionID := <-changed:
+		t.Fatalf("unchanged edition %s reported", editionID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	replaceFile(t, path, readTestDatabase(t, "GeoIP2-City-Test"))
+	select {
+	case editionID := <-changed:
+		if editionID != "GeoIP2-Country-Test" {
+			t.Errorf("changed edition %s, want GeoIP2-Country-Test", editionID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("changed file not detected")
+	}
+}
+
+func TestWatchReloadEmitsLoaded(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "GeoIP2-Country-Test.mmdb")
+	replaceFile(t, path, readTestDatabase(t, "GeoIP2-Country-Test"))
+
+	d := newDatabases(GeoIP2State{
+		DatabaseDirectory: dir,
+		EditionIDs:        []string{"GeoIP2-Country-Test"},
+	})
+	emitter, h := newRecordingEmitter(t)
+	d.events.Store(emitter)
+	t.Cleanup(func() { d.Destruct() })
+	d.loadGeoIPReaders()
+	h.take()
+
+	replaceFile(t, path, readTestDatabase(t, "GeoIP2-Country-Test"))
+	touchFile(t, path)
+	d.reloadChangedDatabase(d.configs[0], make(map[string]fileStamp))
+	events := h.take()
+	if got := eventNames(events); !slices.Equal(got, []string{eventDatabaseLoaded}) {
+		t.Fatalf("events %v, want %v", got, []string{eventDatabaseLoaded})
+	}
+	if loaded := events[0].Data; loaded["database"] != "GeoIP2-Country-Test" ||
+		loaded["database_type"] != "GeoIP2-Country" || loaded["build_epoch"] == nil {
+		t.Errorf("unexpected database_loaded data: %v", loaded)
+	}
+}
@@ -40,6 +40,18 @@ func (r *Anonymous) Close() error {
 	return r.reader.Close()
 }
 
+// Metadata returns the metadata of the database.
+func (r *Anonymous) Metadata() maxminddb.Metadata {
+	return r.reader.Metadata
+}
+
+// Record returns the raw database record for the provided clientIP.
+func (r *Anonymous) Record(clientIP net.IP) (map[string]any, error) {
+	var record map[string]any
+	err := r.reader.Lookup(clientIP, &record)
+	return record, err
+}
+
 // SetAnonymous sets values for possible replacer variables.
 func SetAnonymous(repl *caddy.Replacer, record geoip2.AnonymousIP) {
 	repl.Set("geoip2.is_anonymous", record.IsAnonymous)
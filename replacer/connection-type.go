@@ -39,6 +39,18 @@ func (r *ConnectionType) Close() error {
 	return r.reader.Close()
 }
 
+// Metadata returns the metadata of the database.
+func (r *ConnectionType) Metadata() maxminddb.Metadata {
+	return r.reader.Metadata
+}
+
+// Record returns the raw database record for the provided clientIP.
+func (r *ConnectionType) Record(clientIP net.IP) (map[string]any, error) {
+	var record map[string]any
+	err := r.reader.Lookup(clientIP, &record)
+	return record, err
+}
+
 // SetConnectionType sets values for possible replacer variables.
 func SetConnectionType(repl *caddy.Replacer, record geoip2.ConnectionType) {
 	repl.Set("geoip2.connection_type", record.ConnectionType)
@@ -40,6 +40,18 @@ func (r *Domain) Close() error {
 	return r.reader.Close()
 }
 
+// Metadata returns the metadata of the database.
+func (r *Domain) Metadata() maxminddb.Metadata {
+	return r.reader.Metadata
+}
+
+// Record returns the raw database record for the provided clientIP.
+func (r *Domain) Record(clientIP net.IP) (map[string]any, error) {
+	var record map[string]any
+	err := r.reader.Lookup(clientIP, &record)
+	return record, err
+}
+
 // SetDomain sets values for possible replacer variables.
 func SetDomain(repl *caddy.Replacer, record geoip2.Domain) {
 	repl.Set("geoip2.domain", record.Domain)
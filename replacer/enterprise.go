@@ -42,6 +42,18 @@ func (r *Enterprise) Close() error {
 	return r.reader.Close()
 }
 
+// Metadata returns the metadata of the database.
+func (r *Enterprise) Metadata() maxminddb.Metadata {
+	return r.reader.Metadata
+}
+
+// Record returns the raw database record for the provided clientIP.
+func (r *Enterprise) Record(clientIP net.IP) (map[string]any, error) {
+	var record map[string]any
+	err := r.reader.Lookup(clientIP, &record)
+	return record, err
+}
+
 // languageCodes is the list of languages used for names.
 var languageCodes = []string{"de", "en", "es", "fr", "ja", "pt-BR", "ru", "zh-CN"}
 
@@ -0,0 +1,94 @@
+package replacer
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+// IPinfo represents a geoip reader for the free IPinfo databases.
+type IPinfo struct {
+	reader *maxminddb.Reader
+}
+
+// IPinfoRecord is a record of the free IPinfo databases. IPinfo Lite
+// stores the country code in country_code and its name in country,
+// while the older Country ASN database stores the code in country
+// and the name in country_name. The same applies to the continent.
+type IPinfoRecord struct {
+	ASN           string `maxminddb:"asn"`
+	ASName        string `maxminddb:"as_name"`
+	ASDomain      string `maxminddb:"as_domain"`
+	Country       string `maxminddb:"country"`
+	CountryCode   string `maxminddb:"country_code"`
+	CountryName   string `maxminddb:"country_name"`
+	Continent     string `maxminddb:"continent"`
+	ContinentCode string `maxminddb:"continent_code"`
+	ContinentName string `maxminddb:"continent_name"`
+}
+
+// Lookup performs a database lookup on the provided clientIP and sets
+// the related replacer variables.
+func (r *IPinfo) Lookup(repl *caddy.Replacer, clientIP net.IP) {
+	var record IPinfoRecord
+	err := r.reader.Lookup(clientIP, &record)
+	if err != nil {
+		caddy.Log().Named("geoip2").
+			Error(fmt.Sprintf(
+				"looking up IPinfo record for IP %q: %+v",
+				clientIP.String(),
+				err,
+			))
+	}
+
+	SetIPinfo(repl, record)
+
+	caddy.Log().Named("http.handlers.geoip2").
+		Debug("Lookup IPinfo", zap.String("clientIP", clientIP.String()), zap.Any("record", record))
+}
+
+// Close closes the database reader.
+func (r *IPinfo) Close() error {
+	return r.reader.Close()
+}
+
+// Metadata returns the metadata of the database.
+func (r *IPinfo) Metadata() maxminddb.Metadata {
+	return r.reader.Metadata
+}
+
+// Record returns the raw database record for the provided clientIP.
+func (r *IPinfo) Record(clientIP net.IP) (map[string]any, error) {
+	var record map[string]any
+	err := r.reader.Lookup(clientIP, &record)
+	return record, err
+}
+
+// SetIPinfo sets values for possible replacer variables.
+func SetIPinfo(repl *caddy.Replacer, record IPinfoRecord) {
+	countryCode, countryName := record.CountryCode, record.Country
+	if countryCode == "" {
+		countryCode, countryName = record.Country, record.CountryName
+	}
+	continentCode, continentName := record.ContinentCode, record.Continent
+	if continentCode == "" {
+		continentCode, continentName = record.Continent, record.ContinentName
+	}
+	var asn uint
+	if n, err := strconv.ParseUint(strings.TrimPrefix(record.ASN, "AS"), 10, 0); err == nil {
+		asn = uint(n)
+	}
+
+	repl.Set("geoip2.country_code", countryCode)
+	repl.Set("geoip2.country_name", countryName)
+	repl.Set("geoip2.continent_code", continentCode)
+	repl.Set("geoip2.continent_name", continentName)
+	repl.Set("geoip2.autonomous_system_number", asn)
+	repl.Set("geoip2.autonomous_system_organization", record.ASName)
+	repl.Set("geoip2.autonomous_system_domain", record.ASDomain)
+}
@@ -0,0 +1,42 @@
+package replacer
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSetIPinfo(t *testing.T) {
+	// IPinfo Lite
+	repl := caddy.NewEmptyReplacer()
+	SetIPinfo(repl, IPinfoRecord{
+		ASN:           "AS15169",
+		ASName:        "Google LLC",
+		ASDomain:      "google.com",
+		Country:       "United States",
+		CountryCode:   "US",
+		Continent:     "North America",
+		ContinentCode: "NA",
+	})
+	equal(t, repl, "geoip2.country_code", "US")
+	equal(t, repl, "geoip2.country_name", "United States")
+	equal(t, repl, "geoip2.continent_code", "NA")
+	equal(t, repl, "geoip2.continent_name", "North America")
+	equal(t, repl, "geoip2.autonomous_system_number", uint(15169))
+	equal(t, repl, "geoip2.autonomous_system_organization", "Google LLC")
+	equal(t, repl, "geoip2.autonomous_system_domain", "google.com")
+
+	// IPinfo Country ASN
+	repl = caddy.NewEmptyReplacer()
+	SetIPinfo(repl, IPinfoRecord{
+		Country:       "GB",
+		CountryName:   "United Kingdom",
+		Continent:     "EU",
+		ContinentName: "Europe",
+	})
+	equal(t, repl, "geoip2.country_code", "GB")
+	equal(t, repl, "geoip2.country_name", "United Kingdom")
+	equal(t, repl, "geoip2.continent_code", "EU")
+	equal(t, repl, "geoip2.continent_name", "Europe")
+	equal(t, repl, "geoip2.autonomous_system_number", uint(0))
+}
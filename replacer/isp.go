@@ -40,6 +40,18 @@ func (r *ISP) Close() error {
 	return r.reader.Close()
 }
 
+// Metadata returns the metadata of the database.
+func (r *ISP) Metadata() maxminddb.Metadata {
+	return r.reader.Metadata
+}
+
+// Record returns the raw database record for the provided clientIP.
+func (r *ISP) Record(clientIP net.IP) (map[string]any, error) {
+	var record map[string]any
+	err := r.reader.Lookup(clientIP, &record)
+	return record, err
+}
+
 // SetISP sets values for possible replacer variables.
 func SetISP(repl *caddy.Replacer, record geoip2.ISP) {
 	repl.Set("geoip2.autonomous_system_number", record.AutonomousSystemNumber)
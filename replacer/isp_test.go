@@ -55,3 +55,28 @@ func TestASNLookup(t *testing.T) {
 	equal(t, repl, "geoip2.mobile_network_code", "")
 	equal(t, repl, "geoip2.organization", "")
 }
+
+func TestASNRecord(t *testing.T) {
+	reader, err := New("test-data/test-data/GeoLite2-ASN-Test.mmdb")
+	if err != nil {
+		t.Fatalf("initializing db reader: %+v", err)
+	}
+
+	t.Cleanup(func() {
+		err := reader.Close()
+		if err != nil {
+			t.Fatalf("closing db reader: %+v", err)
+		}
+	})
+
+	record, err := reader.Record(net.ParseIP("1.130.5.12"))
+	if err != nil {
+		t.Fatalf("looking up record: %+v", err)
+	}
+	if record["autonomous_system_number"] != uint64(1221) {
+		t.Errorf("autonomous_system_number = %v, want 1221", record["autonomous_system_number"])
+	}
+	if record["autonomous_system_organization"] != "Telstra Pty Ltd" {
+		t.Errorf("autonomous_system_organization = %v", record["autonomous_system_organization"])
+	}
+}
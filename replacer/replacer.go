@@ -4,6 +4,7 @@ package replacer
 import (
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/oschwald/geoip2-golang"
@@ -13,18 +14,40 @@ import (
 // Replacer is a common interface for the various database types repacers.
 type Replacer interface {
 	Lookup(*caddy.Replacer, net.IP)
+	Record(net.IP) (map[string]any, error)
+	Metadata() maxminddb.Metadata
 	Close() error
 }
 
 // New initializes a geoip replacer based on the provided database type.
 func New(filePath string) (Replacer, error) {
+	return open(filePath, false)
+}
+
+// NewVerified is like New, but verifies the structure of the database
+// first, so that corrupt or truncated files are rejected.
+func NewVerified(filePath string) (Replacer, error) {
+	return open(filePath, true)
+}
+
+func open(filePath string, verify bool) (Replacer, error) {
 	reader, err := maxminddb.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("opening geoip database reader: %w", err)
 	}
+	if verify {
+		if err := reader.Verify(); err != nil {
+			reader.Close()
+			return nil, fmt.Errorf("verifying geoip database: %w", err)
+		}
+	}
 
 	replacer, err := getReplacerForType(reader)
-	return replacer, err
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return replacer, nil
 }
 
 func getReplacerForType(reader *maxminddb.Reader) (Replacer, error) {
@@ -60,6 +83,11 @@ func getReplacerForType(reader *maxminddb.Reader) (Replacer, error) {
 	case "GeoIP2-Anonymous-IP":
 		return &Anonymous{reader: reader}, nil
 	default:
+		// IPinfo names its database types after their files,
+		// e.g. "ipinfo ipinfo_lite.mmdb".
+		if strings.HasPrefix(reader.Metadata.DatabaseType, "ipinfo ") {
+			return &IPinfo{reader: reader}, nil
+		}
 		return nil, fmt.Errorf("database type %q not supported", reader.Metadata.DatabaseType)
 	}
 }
@@ -74,4 +102,5 @@ func SetDefaultValues(repl *caddy.Replacer) {
 	SetDomain(repl, geoip2.Domain{})
 	SetISP(repl, geoip2.ISP{})
 	SetEnterprise(repl, geoip2.Enterprise{})
+	SetIPinfo(repl, IPinfoRecord{})
 }